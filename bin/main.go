@@ -1,10 +1,146 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
 	"github.com/docker/machine/libmachine/drivers/plugin"
+	"github.com/docker/machine/libmachine/mcnutils"
 	"github.com/km4rcus/docker-machine-opennebula"
 )
 
+const usage = `Usage: docker-machine-driver-opennebula [--storage-path PATH] COMMAND MACHINE [ARGS]
+
+Commands:
+  migrate [--live] MACHINE HOST      Migrate the machine to another host
+  resched MACHINE                    Let the scheduler move the machine to another host
+  attach-volatile-disk MACHINE SIZE  Attach a new volatile disk of SIZE MB
+  attach-image-disk MACHINE IMAGE    Attach an existing image, by name or ID
+  detach-disk MACHINE DISK_ID        Detach a disk
+  save-disk-as MACHINE NAME          Save the OS disk as a new image
+  rotate-ssh-key MACHINE             Replace the machine key with a new one
+  resize-disk MACHINE DISK_ID SIZE   Grow a disk to SIZE MB
+`
+
 func main() {
+	// docker-machine runs the plugin without arguments, the operations it
+	// has no command for are run by hand
+	if len(os.Args) > 1 {
+		if err := operation(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	plugin.RegisterDriver(opennebula.NewDriver("", ""))
 }
+
+func operation(args []string) error {
+	flags := flag.NewFlagSet("docker-machine-driver-opennebula", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	storage := flags.String("storage-path", defaultStoragePath(), "Path of the docker-machine store")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	command := flags.Arg(0)
+	cmd_flags := flag.NewFlagSet(command, flag.ExitOnError)
+	cmd_flags.Usage = flags.Usage
+	live := cmd_flags.Bool("live", false, "Migrate without powering off the machine")
+	cmd_flags.Parse(flags.Args()[1:])
+	cmd_args := cmd_flags.Args()
+
+	if len(cmd_args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	d, err := loadDriver(*storage, cmd_args[0])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case command == "migrate" && len(cmd_args) == 2:
+		return d.Migrate(cmd_args[1], *live)
+	case command == "resched" && len(cmd_args) == 1:
+		return d.Reschedule()
+	case command == "attach-volatile-disk" && len(cmd_args) == 2:
+		return printDiskId(d.AttachVolatileDisk(cmd_args[1]))
+	case command == "attach-image-disk" && len(cmd_args) == 2:
+		return printDiskId(d.AttachImageDisk(cmd_args[1]))
+	case command == "detach-disk" && len(cmd_args) == 2:
+		disk_id, err := strconv.Atoi(cmd_args[1])
+		if err != nil {
+			return fmt.Errorf("Invalid disk ID %s", cmd_args[1])
+		}
+		return d.DetachDisk(disk_id)
+	case command == "save-disk-as" && len(cmd_args) == 2:
+		image_id, err := d.SaveDiskAs(cmd_args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(image_id)
+		return nil
+	case command == "rotate-ssh-key" && len(cmd_args) == 1:
+		return d.RotateSSHKey()
+	case command == "resize-disk" && len(cmd_args) == 3:
+		disk_id, err := strconv.Atoi(cmd_args[1])
+		if err != nil {
+			return fmt.Errorf("Invalid disk ID %s", cmd_args[1])
+		}
+		return d.ResizeDisk(disk_id, cmd_args[2])
+	}
+
+	flags.Usage()
+	os.Exit(2)
+	return nil
+}
+
+// loadDriver reads the driver configuration docker-machine saved for the
+// machine, so the operations act on the same VM, key and settings
+func loadDriver(storage, machine string) (*opennebula.Driver, error) {
+	config, err := ioutil.ReadFile(filepath.Join(storage, "machines", machine, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	host := struct {
+		DriverName string
+		Driver     *opennebula.Driver
+	}{Driver: opennebula.NewDriver(machine, storage)}
+	if err = json.Unmarshal(config, &host); err != nil {
+		return nil, err
+	}
+
+	if host.DriverName != "opennebula" {
+		return nil, fmt.Errorf("Machine %s uses the %s driver", machine, host.DriverName)
+	}
+
+	return host.Driver, nil
+}
+
+func defaultStoragePath() string {
+	if path := os.Getenv("MACHINE_STORAGE_PATH"); path != "" {
+		return path
+	}
+	return filepath.Join(mcnutils.GetHomeDir(), ".docker", "machine")
+}
+
+func printDiskId(disk_id int, err error) error {
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(disk_id)
+	return nil
+}
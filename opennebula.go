@@ -1,42 +1,190 @@
 package opennebula
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/OpenNebula/goca"
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/mcnutils"
 	"github.com/docker/machine/libmachine/ssh"
 	"github.com/docker/machine/libmachine/state"
+	cryptossh "golang.org/x/crypto/ssh"
+	"launchpad.net/xmlpath"
 )
 
 type Driver struct {
 	*drivers.BaseDriver
-	NetworkName     string
-	NetworkOwner    string
-	NetworkId       string
-	CPU             string
-	VCPU            string
-	Memory          string
-	DiskSize        string
-	Boot2DockerURL  string
-	DatastoreId     string
+	NetworkName         string
+	NetworkOwner        string
+	NetworkOwnerId      string
+	NetworkId           string
+	NetworkAuto         bool
+	NetworkSchedReqs    string
+	ReserveSize         int
+	ReservationId       string
+	IP                  string
+	PreferIPv6          bool
+	SSHIPFamily         string
+	DockerIPFamily      string
+	DockerURLHost       string
+	SSHNetwork          string
+	DataNetwork         string
+	ExternalIPAttr      string
+	FloatingNetwork     string
+	FloatingIP          string
+	NICAliases          []string
+	PublicNetwork       string
+	IPTimeout           int
+	BootTimeout         int
+	PendingTimeout      int
+	StopTimeout         int
+	PollMaxInterval     int
+	RecoverRetries      int
+	AttachVMId          string
+	UniqueName          bool
+	VMName              string
+	NICModel            string
+	NICDefaultModel     string
+	NICDefaultSecGroups string
+	NICDefaultFilter    string
+	NICFilter           string
+	FilterIPSpoofing    bool
+	FilterMACSpoofing   bool
+	VlanId              string
+	PhyDev              string
+	InboundAvgBW        string
+	InboundPeakBW       string
+	InboundPeakKB       string
+	OutboundAvgBW       string
+	OutboundPeakBW      string
+	OutboundPeakKB      string
+	DNS                 string
+	Gateway             string
+	SearchDomain        string
+	StaticIP            string
+	StaticMask          string
+	CPU                 string
+	VCPU                string
+	Memory              string
+	SchedRank           string
+	SchedDSReqs         string
+	SchedDSRank         string
+	DiskSize            string
+	OSDiskSize          string
+	ExtraDiskSizes      []string
+	ExtraDiskImages     []string
+	SwapSize            string
+	DevPrefix           string
+	DiskCache           string
+	DiskIO              string
+	DiskDiscard         bool
+	DiskAttrs           []string
+	DiskFormat          string
+	DiskFS              string
+	TotalBytesSec       string
+	ReadBytesSec        string
+	WriteBytesSec       string
+	TotalIOPSSec        string
+	ReadIOPSSec         string
+	WriteIOPSSec        string
+	Boot2DockerURL      string
+	MarketplaceApp      string
+	BaseImage           string
+	DatastoreId         string
+	DatastoreName       string
+	ImageReadyTimeout   int
+	Persistent          bool
+	OSType              string
+	CDROM               bool
+	PersistentData      bool
+	DataImageId         string
+	DataImageName       string
+	DataDisk            bool
+	SnapshotDisks       bool
+	StopGracePeriod     int
+	StopUndeploys       bool
+	StopSuspends        bool
+	DataDiskPassphrase  string
+	LUKSSecret          string
+	BackupDatastoreId   string
+	BackupMode          string
+	BackupKeepLast      int
+	BackupInterval      int
+	SSHBastionHost      string
+	SSHBastionUser      string
+	SSHBastionKey       string
+	SSHHostKeyCheck     bool
+	SSHHostKey          string
+	UserDataFile        string
+	StartScript         string
+	StartScriptFile     string
+	ContextFiles        []string
+	Hostname            string
+	SSHExtraKeys        []string
+	Context             []string
+	OneGate             bool
+	ReadyWait           string
+	RegistryMirrors     []string
+	InsecureRegistries  []string
+	DaemonOpts          []string
+	EngineHTTPProxy     string
+	EngineHTTPSProxy    string
+	EngineNoProxy       string
+	NTPServer           string
+	Password            string
+	CryptedPassword     string
+	GrowFS              string
+	NoGrowFS            bool
+	Routes              []string
+	NoContext           bool
+	SSHKey              string
+	Timezone            string
+	InlineFiles         []string
+	RequireContext      bool
+	RenderTemplates     bool
+
+	hostKeyErr error
 }
 
 const (
-	defaultTimeout        = 1 * time.Second
-	defaultSSHUser        = "docker"
-	defaultCPU            = "1"
-	defaultVCPU           = ""
-	defaultMemory         = "1024"
-	defaultDiskSize       = "20000"
-	defaultBoot2DockerURL = "https://s3.eu-central-1.amazonaws.com/one-boot2d/boot2docker-v1.9.1.iso"
-	defaultDatastoreId    = "1"
+	defaultTimeout           = 1 * time.Second
+	defaultSSHUser           = "docker"
+	defaultGenericSSHUser    = "root"
+	defaultCPU               = "1"
+	defaultVCPU              = ""
+	defaultMemory            = "1024"
+	defaultDiskSize          = "20000"
+	defaultBoot2DockerURL    = "https://s3.eu-central-1.amazonaws.com/one-boot2d/boot2docker-v1.9.1.iso"
+	defaultDatastoreId       = "1"
+	defaultImageReadyTimeout = 600
+	defaultOSType            = "boot2docker"
+	defaultIPTimeout         = 120
+	defaultBootTimeout       = 100
+	defaultPendingTimeout    = 60
+	defaultStopTimeout       = 100
+	defaultPollMaxInterval   = 10
+	defaultRecoverRetries    = 2
+	defaultReadyWait         = "ssh"
+	defaultDiskFormat        = "raw"
+	defaultBackupMode        = "FULL"
+	defaultStopGracePeriod   = 60
+	defaultBackupInterval    = 24
 )
 
 func NewDriver(hostName, storePath string) *Driver {
@@ -67,9 +215,195 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-ssh-user",
-			Usage:  "Set the name of the SSH user",
+			Usage:  "Set the name of the SSH user, by default \"docker\" for boot2docker and \"root\" for generic images",
 			EnvVar: "ONE_SSH_USER",
-			Value:  defaultSSHUser,
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ssh-bastion-host",
+			Usage:  "Jump host, as host[:port], through which the machine is reached over SSH",
+			EnvVar: "ONE_SSH_BASTION_HOST",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ssh-bastion-user",
+			Usage:  "SSH user on the jump host, by default the local user",
+			EnvVar: "ONE_SSH_BASTION_USER",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ssh-bastion-key",
+			Usage:  "Private key for the jump host, by default ~/.ssh/id_rsa",
+			EnvVar: "ONE_SSH_BASTION_KEY",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-ssh-host-key-check",
+			Usage:  "Verify the SSH host key of the machine against the one published through OneGate or seen on first boot",
+			EnvVar: "ONE_SSH_HOST_KEY_CHECK",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-user-data",
+			Usage:  "Path of a cloud-init user-data file passed to the machine through the context",
+			EnvVar: "ONE_USER_DATA",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-start-script",
+			Usage:  "Script run by the context packages when the machine boots",
+			EnvVar: "ONE_START_SCRIPT",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-start-script-file",
+			Usage:  "Path of a script run by the context packages when the machine boots",
+			EnvVar: "ONE_START_SCRIPT_FILE",
+			Value:  "",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-docker-registry-mirror",
+			Usage:  "Registry mirror written to the daemon.json of the machine, can be repeated",
+			EnvVar: "ONE_DOCKER_REGISTRY_MIRROR",
+			Value:  []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-docker-insecure-registry",
+			Usage:  "Insecure registry written to the daemon.json of the machine, can be repeated",
+			EnvVar: "ONE_DOCKER_INSECURE_REGISTRY",
+			Value:  []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-docker-daemon-opt",
+			Usage:  "Key of the daemon.json of the machine, as KEY=VALUE with VALUE in JSON or a plain string, can be repeated",
+			EnvVar: "ONE_DOCKER_DAEMON_OPT",
+			Value:  []string{},
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-engine-http-proxy",
+			Usage:  "HTTP_PROXY of the docker engine of the machine",
+			EnvVar: "ONE_ENGINE_HTTP_PROXY",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-engine-https-proxy",
+			Usage:  "HTTPS_PROXY of the docker engine of the machine",
+			EnvVar: "ONE_ENGINE_HTTPS_PROXY",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-engine-no-proxy",
+			Usage:  "NO_PROXY of the docker engine of the machine",
+			EnvVar: "ONE_ENGINE_NO_PROXY",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-password",
+			Usage:  "Password of the SSH user, used to authorize the machine key on images that ignore SSH_PUBLIC_KEY",
+			EnvVar: "ONE_PASSWORD",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-crypted-password",
+			Usage:  "Crypted form of --opennebula-password sent to the machine instead of the plain one",
+			EnvVar: "ONE_CRYPTED_PASSWORD",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-require-context",
+			Usage:  "Fail instead of warning when --opennebula-base-image does not declare the context packages",
+			EnvVar: "ONE_REQUIRE_CONTEXT",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-no-context",
+			Usage:  "Do not attach a CONTEXT to the machine, requires --opennebula-ssh-key",
+			EnvVar: "ONE_NO_CONTEXT",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ssh-key",
+			Usage:  "Private key already authorized on the image, used instead of generating one",
+			EnvVar: "ONE_SSH_KEY",
+			Value:  "",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-route",
+			Usage:  "Static route of the machine, as DEST via GATEWAY [dev ethN] with eth0 by default, can be repeated",
+			EnvVar: "ONE_ROUTE",
+			Value:  []string{},
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-grow-fs",
+			Usage:  "Space separated mount points grown to the size of their disk at boot, defaults to / when --opennebula-os-disk-size is set",
+			EnvVar: "ONE_GROW_FS",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-no-grow-fs",
+			Usage:  "Do not grow any filesystem at boot",
+			EnvVar: "ONE_NO_GROW_FS",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-timezone",
+			Usage:  "Timezone of the machine, e.g. Europe/Madrid",
+			EnvVar: "ONE_TIMEZONE",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ntp-server",
+			Usage:  "NTP server of the machine",
+			EnvVar: "ONE_NTP_SERVER",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-onegate",
+			Usage:  "Give the machine a OneGate token",
+			EnvVar: "ONE_ONEGATE",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ready-wait",
+			Usage:  "How start waits for the machine to boot: ssh, onegate for the READY it reports through OneGate, or both",
+			EnvVar: "ONE_READY_WAIT",
+			Value:  defaultReadyWait,
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-render-templates",
+			Usage:  "Render {{.MachineName}}, {{.IPAddress}} and {{.SSHUser}} in the --opennebula-context values and the user-data file",
+			EnvVar: "ONE_RENDER_TEMPLATES",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-context",
+			Usage:  "Context variable set on the machine, as KEY=VALUE, can be repeated",
+			EnvVar: "ONE_CONTEXT",
+			Value:  []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-ssh-extra-key",
+			Usage:  "Additional SSH public key, or path of a public key file, authorized on the machine, can be repeated",
+			EnvVar: "ONE_SSH_EXTRA_KEY",
+			Value:  []string{},
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-hostname",
+			Usage:  "Hostname set in the guest, defaults to the machine name",
+			EnvVar: "ONE_HOSTNAME",
+			Value:  "",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-inline-file",
+			Usage:  "Small local file copied to the machine at boot through the context, as LOCAL:REMOTE, can be repeated",
+			EnvVar: "ONE_INLINE_FILE",
+			Value:  []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-context-files",
+			Usage:  "Name or ID of an image in a FILES datastore copied to the machine at boot, can be repeated",
+			EnvVar: "ONE_CONTEXT_FILES",
+			Value:  []string{},
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-os-type",
+			Usage:  "Type of the OS image, \"boot2docker\" or \"generic\" for standard distributions provisioned by docker-machine",
+			EnvVar: "ONE_OS_TYPE",
+			Value:  defaultOSType,
 		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-vcpu",
@@ -77,12 +411,131 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			EnvVar: "ONE_VCPU",
 			Value:  defaultCPU,
 		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-sched-rank",
+			Usage:  "Expression the scheduler ranks the hosts for the VM by, e.g. FREE_CPU",
+			EnvVar: "ONE_SCHED_RANK",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-sched-ds-requirements",
+			Usage:  "Requirements the system datastore of the VM must meet, e.g. NAME = \"ssd\"",
+			EnvVar: "ONE_SCHED_DS_REQUIREMENTS",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-sched-ds-rank",
+			Usage:  "Expression the scheduler ranks the system datastores for the VM by, e.g. FREE_MB",
+			EnvVar: "ONE_SCHED_DS_RANK",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-disk-size",
 			Usage:  "Size of disk for VM in MB",
 			EnvVar: "ONE_DISK_SIZE",
 			Value:  defaultDiskSize,
 		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-os-disk-size",
+			Usage:  "Size of the OS disk for VM in MB, by default the size of the image",
+			EnvVar: "ONE_OS_DISK_SIZE",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-dev-prefix",
+			Usage:  "Device prefix of the disks: sd, vd or hd. By default sd, and the one of the image for the OS disk of generic images",
+			EnvVar: "ONE_DEV_PREFIX",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-format",
+			Usage:  "FORMAT of the volatile disks: raw, qcow2, or default for the one of the datastore",
+			EnvVar: "ONE_DISK_FORMAT",
+			Value:  defaultDiskFormat,
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-fs",
+			Usage:  "Filesystem oned creates on the volatile disks: ext2, ext3, ext4 or xfs",
+			EnvVar: "ONE_DISK_FS",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-cache",
+			Usage:  "CACHE of the disks: default, none, writethrough, writeback, directsync or unsafe",
+			EnvVar: "ONE_DISK_CACHE",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-io",
+			Usage:  "IO of the disks: native or threads",
+			EnvVar: "ONE_DISK_IO",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-disk-discard",
+			Usage:  "Pass discard requests of the guest to the storage of the disks",
+			EnvVar: "ONE_DISK_DISCARD",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-disk-attr",
+			Usage:  "Attribute set on the disks for the storage backend, as KEY=VALUE, can be repeated",
+			EnvVar: "ONE_DISK_ATTR",
+			Value:  []string{},
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-total-bytes-sec",
+			Usage:  "Limit of the total throughput of each disk in bytes/s",
+			EnvVar: "ONE_DISK_TOTAL_BYTES_SEC",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-read-bytes-sec",
+			Usage:  "Limit of the read throughput of each disk in bytes/s",
+			EnvVar: "ONE_DISK_READ_BYTES_SEC",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-write-bytes-sec",
+			Usage:  "Limit of the write throughput of each disk in bytes/s",
+			EnvVar: "ONE_DISK_WRITE_BYTES_SEC",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-total-iops-sec",
+			Usage:  "Limit of the total IOPS of each disk",
+			EnvVar: "ONE_DISK_TOTAL_IOPS_SEC",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-read-iops-sec",
+			Usage:  "Limit of the read IOPS of each disk",
+			EnvVar: "ONE_DISK_READ_IOPS_SEC",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-disk-write-iops-sec",
+			Usage:  "Limit of the write IOPS of each disk",
+			EnvVar: "ONE_DISK_WRITE_IOPS_SEC",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-swap-size",
+			Usage:  "Size in MB of a volatile swap disk",
+			EnvVar: "ONE_SWAP_SIZE",
+			Value:  "",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-extra-disk-size",
+			Usage:  "Size in MB of an additional volatile disk, can be repeated",
+			EnvVar: "ONE_EXTRA_DISK_SIZE",
+			Value:  []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-extra-disk-image",
+			Usage:  "Name or ID of an image attached as an additional disk, can be repeated",
+			EnvVar: "ONE_EXTRA_DISK_IMAGE",
+			Value:  []string{},
+		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-network-name",
 			Usage:  "Network to connect the machine to",
@@ -101,6 +554,277 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			EnvVar: "ONE_NETWORK_OWNER",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-marketplace-app",
+			Usage:  "Name or ID of a Marketplace appliance to use as the OS image instead of --opennebula-boot2docker-url",
+			EnvVar: "ONE_MARKETPLACE_APP",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-base-image",
+			Usage:  "Name or ID of an image cloned for each machine instead of importing --opennebula-boot2docker-url",
+			EnvVar: "ONE_BASE_IMAGE",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-network-owner-id",
+			Usage:  "User ID of the owner of the Network to connect the machine to",
+			EnvVar: "ONE_NETWORK_OWNER_ID",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-network-auto",
+			Usage:  "Let the scheduler select the network to connect the machine to",
+			EnvVar: "ONE_NETWORK_AUTO",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-network-sched-requirements",
+			Usage:  "Requirements the network selected by --opennebula-network-auto must meet, e.g. TRAFFIC_TYPE=\"public\"",
+			EnvVar: "ONE_NETWORK_SCHED_REQUIREMENTS",
+			Value:  "",
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-network-reserve-size",
+			Usage:  "Number of addresses reserved from the network for the machine, released on remove",
+			EnvVar: "ONE_NETWORK_RESERVE_SIZE",
+			Value:  0,
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-nic-model",
+			Usage:  "Model of the NIC of the VM, e.g. virtio or e1000",
+			EnvVar: "ONE_NIC_MODEL",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-nic-default-model",
+			Usage:  "Model applied to all the NICs of the VM through NIC_DEFAULT",
+			EnvVar: "ONE_NIC_DEFAULT_MODEL",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-nic-default-security-groups",
+			Usage:  "Comma separated security group IDs applied to all the NICs of the VM through NIC_DEFAULT",
+			EnvVar: "ONE_NIC_DEFAULT_SECURITY_GROUPS",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-nic-default-filter",
+			Usage:  "Network filter applied to all the NICs of the VM through NIC_DEFAULT",
+			EnvVar: "ONE_NIC_DEFAULT_FILTER",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-nic-filter",
+			Usage:  "Network filter of the NIC, e.g. clean-traffic",
+			EnvVar: "ONE_NIC_FILTER",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-filter-ip-spoofing",
+			Usage:  "Drop traffic of the NIC from addresses other than its lease",
+			EnvVar: "ONE_FILTER_IP_SPOOFING",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-filter-mac-spoofing",
+			Usage:  "Drop traffic of the NIC from MAC addresses other than its own",
+			EnvVar: "ONE_FILTER_MAC_SPOOFING",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-vlan-id",
+			Usage:  "VLAN ID of the NIC, overrides the one of the network",
+			EnvVar: "ONE_VLAN_ID",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-phydev",
+			Usage:  "Physical device of the hosts the NIC is bridged to, overrides the one of the network",
+			EnvVar: "ONE_PHYDEV",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-inbound-avg-bw",
+			Usage:  "Average bitrate of the inbound traffic of the NIC in KBytes/s",
+			EnvVar: "ONE_INBOUND_AVG_BW",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-inbound-peak-bw",
+			Usage:  "Peak bitrate of the inbound traffic of the NIC in KBytes/s",
+			EnvVar: "ONE_INBOUND_PEAK_BW",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-inbound-peak-kb",
+			Usage:  "Amount of inbound data in KBytes that can be transmitted at peak bitrate",
+			EnvVar: "ONE_INBOUND_PEAK_KB",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-outbound-avg-bw",
+			Usage:  "Average bitrate of the outbound traffic of the NIC in KBytes/s",
+			EnvVar: "ONE_OUTBOUND_AVG_BW",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-outbound-peak-bw",
+			Usage:  "Peak bitrate of the outbound traffic of the NIC in KBytes/s",
+			EnvVar: "ONE_OUTBOUND_PEAK_BW",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-outbound-peak-kb",
+			Usage:  "Amount of outbound data in KBytes that can be transmitted at peak bitrate",
+			EnvVar: "ONE_OUTBOUND_PEAK_KB",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-dns",
+			Usage:  "DNS servers of the machine, overrides the ones of the network",
+			EnvVar: "ONE_DNS",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-gateway",
+			Usage:  "Default gateway of the machine, overrides the one of the network",
+			EnvVar: "ONE_GATEWAY",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-search-domain",
+			Usage:  "DNS search domains of the machine, overrides the ones of the network",
+			EnvVar: "ONE_SEARCH_DOMAIN",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-static-ip",
+			Usage:  "IP address configured in the guest through the context, for networks without address management",
+			EnvVar: "ONE_STATIC_IP",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-static-mask",
+			Usage:  "Network mask configured in the guest along with --opennebula-static-ip",
+			EnvVar: "ONE_STATIC_MASK",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ip",
+			Usage:  "IP address requested for the machine from the network address range",
+			EnvVar: "ONE_IP",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-ipv6",
+			Usage:  "Use the IPv6 address of the machine even when it also has an IPv4 one",
+			EnvVar: "ONE_IPV6",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ssh-ip-family",
+			Usage:  "Address family used for SSH on dual-stack NICs, \"ipv4\" or \"ipv6\"",
+			EnvVar: "ONE_SSH_IP_FAMILY",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-docker-ip-family",
+			Usage:  "Address family used for the docker URL on dual-stack NICs, \"ipv4\" or \"ipv6\"",
+			EnvVar: "ONE_DOCKER_IP_FAMILY",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-docker-url-host",
+			Usage:  "Host advertised in the docker URL of the machine, SSH still uses the address of the machine",
+			EnvVar: "ONE_DOCKER_URL_HOST",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-ssh-network",
+			Usage:  "Name or ID of the network whose address is used for SSH and docker, by default the first NIC",
+			EnvVar: "ONE_SSH_NETWORK",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-data-network",
+			Usage:  "Name or ID of a second network for container traffic, SSH and docker keep using the management network",
+			EnvVar: "ONE_DATA_NETWORK",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-external-ip-attribute",
+			Usage:  "Attribute of the NIC or the USER_TEMPLATE holding the public address of the machine, e.g. EXTERNAL_IP",
+			EnvVar: "ONE_EXTERNAL_IP_ATTRIBUTE",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-floating-network",
+			Usage:  "Network providing a floating IP attached to the machine as a NIC alias and used as its address",
+			EnvVar: "ONE_FLOATING_NETWORK",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-floating-ip",
+			Usage:  "Floating IP requested from --opennebula-floating-network",
+			EnvVar: "ONE_FLOATING_IP",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-public-network",
+			Usage:  "Public network of an edge cluster the elastic IP of the machine is requested from",
+			EnvVar: "ONE_PUBLIC_NETWORK",
+			Value:  "",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "opennebula-nic-alias",
+			Usage:  "Secondary address on the NIC, as NETWORK or NETWORK:IP, can be repeated",
+			EnvVar: "ONE_NIC_ALIAS",
+			Value:  []string{},
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-ip-timeout",
+			Usage:  "Seconds to wait for the machine to get an IP address",
+			EnvVar: "ONE_IP_TIMEOUT",
+			Value:  defaultIPTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-boot-timeout",
+			Usage:  "Seconds to wait for the machine to be running on start",
+			EnvVar: "ONE_BOOT_TIMEOUT",
+			Value:  defaultBootTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-pending-timeout",
+			Usage:  "Seconds the VM may stay PENDING with a scheduler message before start gives up",
+			EnvVar: "ONE_PENDING_TIMEOUT",
+			Value:  defaultPendingTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-stop-timeout",
+			Usage:  "Seconds to wait for the machine to be powered off once it is powered off hard",
+			EnvVar: "ONE_STOP_TIMEOUT",
+			Value:  defaultStopTimeout,
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-poll-max-interval",
+			Usage:  "Maximum seconds between two polls of the VM and image states",
+			EnvVar: "ONE_POLL_MAX_INTERVAL",
+			Value:  defaultPollMaxInterval,
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-attach-vm-id",
+			Usage:  "ID of an existing VM to take over instead of creating a new one",
+			EnvVar: "ONE_ATTACH_VM_ID",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-unique-name",
+			Usage:  "Give the VM a numbered name when another VM already has the machine name",
+			EnvVar: "ONE_UNIQUE_NAME",
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-recover-retries",
+			Usage:  "Times a VM failing to boot is recovered with a retry before giving up",
+			EnvVar: "ONE_RECOVER_RETRIES",
+			Value:  defaultRecoverRetries,
+		},
 		mcnflag.StringFlag{
 			Name:   "opennebula-datastore-id",
 			Usage:  "Datastore ID of the Boot2Docker image",
@@ -108,33 +832,453 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Value:  defaultDatastoreId,
 		},
 		mcnflag.StringFlag{
-			Name:   "opennebula-boot2docker-url",
-			Usage:  "The URL of the boot2docker image. By default it uses one hosted by OpenNebula.org",
-			EnvVar: "ONE_BOOT2DOCKER_URL",
-			Value:  defaultBoot2DockerURL,
+			Name:   "opennebula-datastore-name",
+			Usage:  "Datastore name of the Boot2Docker image, overrides --opennebula-datastore-id",
+			EnvVar: "ONE_DATASTORE_NAME",
+			Value:  "",
 		},
-	}
-}
-
-func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
-	d.CPU = flags.String("opennebula-cpu")
-	d.VCPU = flags.String("opennebula-vcpu")
-	d.Memory = flags.String("opennebula-memory")
-	d.DiskSize = flags.String("opennebula-disk-size")
-	d.NetworkName = flags.String("opennebula-network-name")
-	d.NetworkId = flags.String("opennebula-network-id")
-	d.NetworkOwner = flags.String("opennebula-network-owner")
-	d.DatastoreId = flags.String("opennebula-datastore-id")
-	d.Boot2DockerURL = flags.String("opennebula-boot2docker-url")
-	d.SSHUser = flags.String("opennebula-ssh-user")
-
-	if d.NetworkName == "" && d.NetworkId == "" {
-		return errors.New("Please specify a network to connect to with --opennebula-network-name or --opennebula-network-id.")
-	}
-
- 	if d.NetworkName != "" && d.NetworkId != "" {
-		return errors.New("Please specify a network to connect to either with  --opennebula-network-name or --opennebula-network-id, not both.")
-	}
+		mcnflag.IntFlag{
+			Name:   "opennebula-image-ready-timeout",
+			Usage:  "Seconds to wait for the Boot2Docker image to become READY",
+			EnvVar: "ONE_IMAGE_READY_TIMEOUT",
+			Value:  defaultImageReadyTimeout,
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-persistent",
+			Usage:  "Make the Boot2Docker image persistent so changes to the OS disk survive stop/undeploy",
+			EnvVar: "ONE_PERSISTENT",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-cdrom",
+			Usage:  "Attach the Boot2Docker ISO as a CDROM and keep the Docker data on a persistent disk",
+			EnvVar: "ONE_CDROM",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-persistent-data",
+			Usage:  "Keep the Docker data on a persistent disk that is preserved when the machine is removed",
+			EnvVar: "ONE_PERSISTENT_DATA",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-data-disk",
+			Usage:  "Give generic images a volatile disk of --opennebula-disk-size MB formatted and mounted as /var/lib/docker",
+			EnvVar: "ONE_DATA_DISK",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-data-image-id",
+			Usage:  "ID of an existing image attached and mounted as /var/lib/docker",
+			EnvVar: "ONE_DATA_IMAGE_ID",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-data-image-name",
+			Usage:  "Name of an existing image attached and mounted as /var/lib/docker",
+			EnvVar: "ONE_DATA_IMAGE_NAME",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-data-disk-passphrase",
+			Usage:  "Passphrase the data disk of generic images is encrypted with LUKS in the guest",
+			EnvVar: "ONE_DATA_DISK_PASSPHRASE",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-luks-secret",
+			Usage:  "LUKS_SECRET of the persistent data disk, for datastores encrypting images at rest",
+			EnvVar: "ONE_LUKS_SECRET",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-backup-datastore-id",
+			Usage:  "Backup datastore the machine is backed up to",
+			EnvVar: "ONE_BACKUP_DATASTORE_ID",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-backup-mode",
+			Usage:  "Backup mode: FULL or INCREMENT",
+			EnvVar: "ONE_BACKUP_MODE",
+			Value:  defaultBackupMode,
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-backup-keep-last",
+			Usage:  "Number of backups kept, 0 keeps all of them",
+			EnvVar: "ONE_BACKUP_KEEP_LAST",
+			Value:  0,
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-backup-interval",
+			Usage:  "Hours between the backups of the machine",
+			EnvVar: "ONE_BACKUP_INTERVAL",
+			Value:  defaultBackupInterval,
+		},
+		mcnflag.IntFlag{
+			Name:   "opennebula-stop-grace-period",
+			Usage:  "Seconds the machine is given to power off on stop before it is powered off hard",
+			EnvVar: "ONE_STOP_GRACE_PERIOD",
+			Value:  defaultStopGracePeriod,
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-stop-undeploys",
+			Usage:  "Undeploy the machine on stop, freeing the resources of the host while keeping its disks",
+			EnvVar: "ONE_STOP_UNDEPLOYS",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-stop-suspends",
+			Usage:  "Suspend the machine on stop, keeping its memory and running containers until it is started again",
+			EnvVar: "ONE_STOP_SUSPENDS",
+		},
+		mcnflag.BoolFlag{
+			Name:   "opennebula-snapshot-disks",
+			Usage:  "Snapshot the disks of the machine before kill and Boot2Docker upgrades",
+			EnvVar: "ONE_SNAPSHOT_DISKS",
+		},
+		mcnflag.StringFlag{
+			Name:   "opennebula-boot2docker-url",
+			Usage:  "The URL of the boot2docker image. By default it uses one hosted by OpenNebula.org",
+			EnvVar: "ONE_BOOT2DOCKER_URL",
+			Value:  defaultBoot2DockerURL,
+		},
+	}
+}
+
+func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	d.SwarmMaster = flags.Bool("swarm-master")
+	d.SwarmHost = flags.String("swarm-host")
+	d.SwarmDiscovery = flags.String("swarm-discovery")
+	d.CPU = flags.String("opennebula-cpu")
+	d.VCPU = flags.String("opennebula-vcpu")
+	d.Memory = flags.String("opennebula-memory")
+	d.SchedRank = flags.String("opennebula-sched-rank")
+	d.SchedDSReqs = flags.String("opennebula-sched-ds-requirements")
+	d.SchedDSRank = flags.String("opennebula-sched-ds-rank")
+	d.DiskSize = flags.String("opennebula-disk-size")
+	d.OSDiskSize = flags.String("opennebula-os-disk-size")
+	d.ExtraDiskSizes = flags.StringSlice("opennebula-extra-disk-size")
+	d.ExtraDiskImages = flags.StringSlice("opennebula-extra-disk-image")
+	d.SwapSize = flags.String("opennebula-swap-size")
+	d.DevPrefix = flags.String("opennebula-dev-prefix")
+
+	switch d.DevPrefix {
+	case "", "sd", "vd", "hd":
+	default:
+		return fmt.Errorf("Invalid device prefix %q, please use sd, vd or hd.", d.DevPrefix)
+	}
+
+	d.DiskFormat = flags.String("opennebula-disk-format")
+	d.DiskFS = flags.String("opennebula-disk-fs")
+	d.DiskCache = flags.String("opennebula-disk-cache")
+
+	switch d.DiskFS {
+	case "", "ext2", "ext3", "ext4", "xfs":
+	default:
+		return fmt.Errorf("Invalid disk filesystem %q, please use ext2, ext3, ext4 or xfs.", d.DiskFS)
+	}
+
+	switch d.DiskFormat {
+	case "raw", "qcow2", "default":
+	default:
+		return fmt.Errorf("Invalid disk format %q, please use raw, qcow2 or default.", d.DiskFormat)
+	}
+	d.DiskIO = flags.String("opennebula-disk-io")
+	d.DiskDiscard = flags.Bool("opennebula-disk-discard")
+	d.DiskAttrs = flags.StringSlice("opennebula-disk-attr")
+
+	for _, attr := range d.DiskAttrs {
+		if strings.Index(attr, "=") < 1 {
+			return fmt.Errorf("Invalid disk attribute %q, please use KEY=VALUE.", attr)
+		}
+	}
+	d.TotalBytesSec = flags.String("opennebula-disk-total-bytes-sec")
+	d.ReadBytesSec = flags.String("opennebula-disk-read-bytes-sec")
+	d.WriteBytesSec = flags.String("opennebula-disk-write-bytes-sec")
+	d.TotalIOPSSec = flags.String("opennebula-disk-total-iops-sec")
+	d.ReadIOPSSec = flags.String("opennebula-disk-read-iops-sec")
+	d.WriteIOPSSec = flags.String("opennebula-disk-write-iops-sec")
+
+	switch d.DiskCache {
+	case "", "default", "none", "writethrough", "writeback", "directsync", "unsafe":
+	default:
+		return fmt.Errorf("Invalid disk cache %q, please use default, none, writethrough, writeback, directsync or unsafe.", d.DiskCache)
+	}
+
+	switch d.DiskIO {
+	case "", "native", "threads":
+	default:
+		return fmt.Errorf("Invalid disk IO %q, please use native or threads.", d.DiskIO)
+	}
+
+	if d.SwapSize != "" {
+		if _, err := strconv.ParseUint(d.SwapSize, 10, 32); err != nil {
+			return fmt.Errorf("Invalid swap size %q, please use a size in MB.", d.SwapSize)
+		}
+	}
+
+	for _, size := range d.ExtraDiskSizes {
+		if _, err := strconv.ParseUint(size, 10, 32); err != nil {
+			return fmt.Errorf("Invalid extra disk size %q, please use a size in MB.", size)
+		}
+	}
+	d.NetworkName = flags.String("opennebula-network-name")
+	d.NetworkId = flags.String("opennebula-network-id")
+	d.NetworkOwner = flags.String("opennebula-network-owner")
+	d.NetworkOwnerId = flags.String("opennebula-network-owner-id")
+	d.NetworkAuto = flags.Bool("opennebula-network-auto")
+	d.NetworkSchedReqs = flags.String("opennebula-network-sched-requirements")
+	d.ReserveSize = flags.Int("opennebula-network-reserve-size")
+	d.IP = flags.String("opennebula-ip")
+	d.NICModel = flags.String("opennebula-nic-model")
+	d.NICDefaultModel = flags.String("opennebula-nic-default-model")
+	d.NICDefaultSecGroups = flags.String("opennebula-nic-default-security-groups")
+	d.NICDefaultFilter = flags.String("opennebula-nic-default-filter")
+	d.NICFilter = flags.String("opennebula-nic-filter")
+	d.FilterIPSpoofing = flags.Bool("opennebula-filter-ip-spoofing")
+	d.FilterMACSpoofing = flags.Bool("opennebula-filter-mac-spoofing")
+	d.VlanId = flags.String("opennebula-vlan-id")
+	d.PhyDev = flags.String("opennebula-phydev")
+	d.InboundAvgBW = flags.String("opennebula-inbound-avg-bw")
+	d.InboundPeakBW = flags.String("opennebula-inbound-peak-bw")
+	d.InboundPeakKB = flags.String("opennebula-inbound-peak-kb")
+	d.OutboundAvgBW = flags.String("opennebula-outbound-avg-bw")
+	d.OutboundPeakBW = flags.String("opennebula-outbound-peak-bw")
+	d.OutboundPeakKB = flags.String("opennebula-outbound-peak-kb")
+	d.DNS = flags.String("opennebula-dns")
+	d.Gateway = flags.String("opennebula-gateway")
+	d.SearchDomain = flags.String("opennebula-search-domain")
+	d.StaticIP = flags.String("opennebula-static-ip")
+	d.StaticMask = flags.String("opennebula-static-mask")
+	d.PreferIPv6 = flags.Bool("opennebula-ipv6")
+	d.SSHIPFamily = flags.String("opennebula-ssh-ip-family")
+	d.DockerIPFamily = flags.String("opennebula-docker-ip-family")
+	d.DockerURLHost = flags.String("opennebula-docker-url-host")
+	d.SSHNetwork = flags.String("opennebula-ssh-network")
+	d.DataNetwork = flags.String("opennebula-data-network")
+	d.ExternalIPAttr = flags.String("opennebula-external-ip-attribute")
+
+	// The attribute is looked up as a step of an XPath expression
+	if d.ExternalIPAttr != "" && !attributeName(d.ExternalIPAttr) {
+		return fmt.Errorf("Invalid external IP attribute %q, please use a template attribute name such as EXTERNAL_IP.", d.ExternalIPAttr)
+	}
+
+	d.FloatingNetwork = flags.String("opennebula-floating-network")
+	d.FloatingIP = flags.String("opennebula-floating-ip")
+	d.NICAliases = flags.StringSlice("opennebula-nic-alias")
+	d.PublicNetwork = flags.String("opennebula-public-network")
+	d.IPTimeout = flags.Int("opennebula-ip-timeout")
+	d.BootTimeout = flags.Int("opennebula-boot-timeout")
+	d.PendingTimeout = flags.Int("opennebula-pending-timeout")
+	d.StopTimeout = flags.Int("opennebula-stop-timeout")
+	d.PollMaxInterval = flags.Int("opennebula-poll-max-interval")
+	d.RecoverRetries = flags.Int("opennebula-recover-retries")
+	d.AttachVMId = flags.String("opennebula-attach-vm-id")
+	d.UniqueName = flags.Bool("opennebula-unique-name")
+	d.DatastoreId = flags.String("opennebula-datastore-id")
+	d.DatastoreName = flags.String("opennebula-datastore-name")
+	d.Boot2DockerURL = flags.String("opennebula-boot2docker-url")
+	d.MarketplaceApp = flags.String("opennebula-marketplace-app")
+	d.BaseImage = flags.String("opennebula-base-image")
+	d.ImageReadyTimeout = flags.Int("opennebula-image-ready-timeout")
+	d.Persistent = flags.Bool("opennebula-persistent")
+	d.SSHUser = flags.String("opennebula-ssh-user")
+	d.OSType = flags.String("opennebula-os-type")
+	d.CDROM = flags.Bool("opennebula-cdrom")
+	d.PersistentData = flags.Bool("opennebula-persistent-data")
+	d.DataImageId = flags.String("opennebula-data-image-id")
+	d.DataImageName = flags.String("opennebula-data-image-name")
+	d.DataDisk = flags.Bool("opennebula-data-disk")
+	d.SnapshotDisks = flags.Bool("opennebula-snapshot-disks")
+	d.StopGracePeriod = flags.Int("opennebula-stop-grace-period")
+	d.StopUndeploys = flags.Bool("opennebula-stop-undeploys")
+	d.StopSuspends = flags.Bool("opennebula-stop-suspends")
+	d.DataDiskPassphrase = flags.String("opennebula-data-disk-passphrase")
+	d.LUKSSecret = flags.String("opennebula-luks-secret")
+	d.BackupDatastoreId = flags.String("opennebula-backup-datastore-id")
+	d.BackupMode = strings.ToUpper(flags.String("opennebula-backup-mode"))
+	d.BackupKeepLast = flags.Int("opennebula-backup-keep-last")
+	d.BackupInterval = flags.Int("opennebula-backup-interval")
+
+	d.ReadyWait = flags.String("opennebula-ready-wait")
+	if d.ReadyWait != "ssh" && d.ReadyWait != "onegate" && d.ReadyWait != "both" {
+		return fmt.Errorf("Invalid ready wait %q, please use ssh, onegate or both.", d.ReadyWait)
+	}
+
+	if d.StopUndeploys && d.StopSuspends {
+		return errors.New("Please specify either --opennebula-stop-undeploys or --opennebula-stop-suspends, not both.")
+	}
+
+	if d.BackupMode != "FULL" && d.BackupMode != "INCREMENT" {
+		return fmt.Errorf("Invalid backup mode %q, please use FULL or INCREMENT.", d.BackupMode)
+	}
+
+	if d.BackupDatastoreId != "" && d.BackupInterval < 1 {
+		return errors.New("The backup interval must be at least 1 hour.")
+	}
+	d.SSHBastionHost = flags.String("opennebula-ssh-bastion-host")
+	d.SSHBastionUser = flags.String("opennebula-ssh-bastion-user")
+	d.SSHBastionKey = flags.String("opennebula-ssh-bastion-key")
+	d.SSHHostKeyCheck = flags.Bool("opennebula-ssh-host-key-check")
+	d.UserDataFile = flags.String("opennebula-user-data")
+	d.StartScript = flags.String("opennebula-start-script")
+	d.StartScriptFile = flags.String("opennebula-start-script-file")
+	d.ContextFiles = flags.StringSlice("opennebula-context-files")
+	d.InlineFiles = flags.StringSlice("opennebula-inline-file")
+
+	for _, file := range d.InlineFiles {
+		if kv := strings.SplitN(file, ":", 2); len(kv) != 2 || kv[0] == "" || !strings.HasPrefix(kv[1], "/") {
+			return fmt.Errorf("Invalid inline file %q, please use LOCAL:REMOTE with an absolute REMOTE path.", file)
+		}
+	}
+	d.Hostname = flags.String("opennebula-hostname")
+	d.SSHExtraKeys = flags.StringSlice("opennebula-ssh-extra-key")
+	d.Context = flags.StringSlice("opennebula-context")
+	d.RenderTemplates = flags.Bool("opennebula-render-templates")
+	d.OneGate = flags.Bool("opennebula-onegate")
+	d.RegistryMirrors = flags.StringSlice("opennebula-docker-registry-mirror")
+	d.InsecureRegistries = flags.StringSlice("opennebula-docker-insecure-registry")
+	d.DaemonOpts = flags.StringSlice("opennebula-docker-daemon-opt")
+	d.EngineHTTPProxy = flags.String("opennebula-engine-http-proxy")
+	d.EngineHTTPSProxy = flags.String("opennebula-engine-https-proxy")
+	d.EngineNoProxy = flags.String("opennebula-engine-no-proxy")
+	d.NTPServer = flags.String("opennebula-ntp-server")
+	d.Timezone = flags.String("opennebula-timezone")
+	d.Password = flags.String("opennebula-password")
+	d.CryptedPassword = flags.String("opennebula-crypted-password")
+	d.NoContext = flags.Bool("opennebula-no-context")
+	d.RequireContext = flags.Bool("opennebula-require-context")
+	d.SSHKey = flags.String("opennebula-ssh-key")
+
+	if d.NoContext && d.SSHKey == "" {
+		return errors.New("Please specify the key authorized on the image with --opennebula-ssh-key, the machine key can't be injected without context.")
+	}
+
+	d.Routes = flags.StringSlice("opennebula-route")
+	if _, _, err := d.routes(); err != nil {
+		return err
+	}
+
+	d.GrowFS = flags.String("opennebula-grow-fs")
+	d.NoGrowFS = flags.Bool("opennebula-no-grow-fs")
+
+	if d.GrowFS != "" && d.NoGrowFS {
+		return errors.New("Please specify either --opennebula-grow-fs or --opennebula-no-grow-fs, not both.")
+	}
+	if d.GrowFS == "" && !d.NoGrowFS && d.OSDiskSize != "" {
+		d.GrowFS = "/"
+	}
+
+	if d.CryptedPassword != "" && d.Password == "" {
+		return errors.New("Please specify --opennebula-password too, the driver logs in with it to authorize the machine key.")
+	}
+
+	for _, opt := range d.DaemonOpts {
+		if strings.Index(opt, "=") < 1 {
+			return fmt.Errorf("Invalid daemon option %q, please use KEY=VALUE.", opt)
+		}
+	}
+
+	for _, variable := range d.Context {
+		if strings.Index(variable, "=") < 1 {
+			return fmt.Errorf("Invalid context variable %q, please use KEY=VALUE.", variable)
+		}
+	}
+
+	if d.StartScript != "" && d.StartScriptFile != "" {
+		return errors.New("Please specify the start script either with --opennebula-start-script or --opennebula-start-script-file, not both.")
+	}
+
+	if d.SSHBastionHost != "" {
+		if d.SSHBastionUser == "" {
+			d.SSHBastionUser = mcnutils.GetUsername()
+		}
+		if d.SSHBastionKey == "" {
+			d.SSHBastionKey = filepath.Join(mcnutils.GetHomeDir(), ".ssh", "id_rsa")
+		}
+	}
+
+	if d.OSType != "boot2docker" && d.OSType != "generic" {
+		return errors.New("Please specify --opennebula-os-type as either boot2docker or generic.")
+	}
+
+	if d.CDROM && d.OSType != "boot2docker" {
+		return errors.New("The --opennebula-cdrom layout is only available for boot2docker.")
+	}
+
+	if d.PersistentData && d.OSType != "boot2docker" {
+		return errors.New("The persistent data disk is only supported with --opennebula-os-type boot2docker.")
+	}
+
+	if d.DataDisk && d.OSType != "generic" {
+		return errors.New("Boot2Docker always has a data disk, --opennebula-data-disk is only needed with --opennebula-os-type generic.")
+	}
+
+	if d.DataDisk && (d.DataImageId != "" || d.DataImageName != "") {
+		return errors.New("Please specify either --opennebula-data-disk or a data image, not both.")
+	}
+
+	if d.DataDiskPassphrase != "" && !(d.OSType == "generic" && (d.DataDisk || d.DataImageId != "" || d.DataImageName != "")) {
+		return errors.New("The data disk can only be encrypted on generic images with --opennebula-data-disk or a data image.")
+	}
+
+	if d.LUKSSecret != "" && !d.CDROM && !d.PersistentData {
+		return errors.New("The LUKS secret only applies to the persistent data disk of --opennebula-cdrom or --opennebula-persistent-data.")
+	}
+
+	if d.DataImageId != "" && d.DataImageName != "" {
+		return errors.New("Please specify the data image either by id or by name, not both.")
+	}
+
+	if (d.DataImageId != "" || d.DataImageName != "") && (d.CDROM || d.PersistentData) {
+		return errors.New("The data image cannot be combined with --opennebula-cdrom or --opennebula-persistent-data, which create their own data disk.")
+	}
+
+	if d.CDROM && d.Persistent {
+		return errors.New("Please specify either --opennebula-cdrom or --opennebula-persistent, CDROM images cannot be persistent.")
+	}
+
+	if d.SSHUser == "" {
+		if d.OSType == "generic" {
+			d.SSHUser = defaultGenericSSHUser
+		} else {
+			d.SSHUser = defaultSSHUser
+		}
+	}
+
+	if d.NetworkAuto {
+		if d.NetworkName != "" || d.NetworkId != "" {
+			return errors.New("Please specify either --opennebula-network-auto or a network to connect to, not both.")
+		}
+	} else if d.NetworkName == "" && d.NetworkId == "" {
+		return errors.New("Please specify a network to connect to with --opennebula-network-name or --opennebula-network-id.")
+	}
+
+	if d.NetworkOwner != "" && d.NetworkOwnerId != "" {
+		return errors.New("Please specify the owner of the network either with --opennebula-network-owner or --opennebula-network-owner-id, not both.")
+	}
+
+	if d.NetworkAuto && d.ReserveSize > 0 {
+		return errors.New("Addresses cannot be reserved with --opennebula-network-auto, please specify a network.")
+	}
+
+	if d.NetworkSchedReqs != "" && !d.NetworkAuto {
+		return errors.New("The --opennebula-network-sched-requirements option requires --opennebula-network-auto.")
+	}
+
+	if d.NetworkName != "" && d.NetworkId != "" {
+		return errors.New("Please specify a network to connect to either with  --opennebula-network-name or --opennebula-network-id, not both.")
+	}
+
+	for _, family := range []string{d.SSHIPFamily, d.DockerIPFamily} {
+		if family != "" && family != "ipv4" && family != "ipv6" {
+			return errors.New("Please specify the address families as either ipv4 or ipv6.")
+		}
+	}
+
+	if d.StaticMask != "" && d.StaticIP == "" {
+		return errors.New("Please specify the address of the machine with --opennebula-static-ip.")
+	}
+
+	if d.FloatingIP != "" && d.FloatingNetwork == "" {
+		return errors.New("Please specify the network of the floating IP with --opennebula-floating-network.")
+	}
 	return nil
 }
 
@@ -143,7 +1287,7 @@ func (d *Driver) DriverName() string {
 }
 
 func (d *Driver) GetSSHHostname() (string, error) {
-	return d.GetIP()
+	return d.getIP(d.SSHIPFamily)
 }
 
 func (d *Driver) GetSSHUsername() string {
@@ -151,354 +1295,3212 @@ func (d *Driver) GetSSHUsername() string {
 }
 
 func (d *Driver) PreCreateCheck() error {
+	// Nothing is created for an adopted VM, it only has to exist
+	if d.AttachVMId != "" {
+		id, err := strconv.ParseUint(d.AttachVMId, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid VM ID %s.", d.AttachVMId)
+		}
+
+		if err = goca.NewVM(uint(id)).Info(); err != nil {
+			return fmt.Errorf("VM %s: %s", d.AttachVMId, err)
+		}
+
+		return nil
+	}
+
+	if err := d.checkVMName(); err != nil {
+		return err
+	}
+
+	if err := d.checkContextPackages(); err != nil {
+		return err
+	}
+
+	// Docker only reads daemon.json from 1.10 on, the default Boot2Docker
+	// ISO ships 1.9.1
+	if d.OSType == "boot2docker" && d.MarketplaceApp == "" && d.BaseImage == "" && d.Boot2DockerURL == defaultBoot2DockerURL &&
+		(len(d.RegistryMirrors) > 0 || len(d.InsecureRegistries) > 0 || len(d.DaemonOpts) > 0) {
+		log.Warnf("The default Boot2Docker ISO runs Docker 1.9.1, which ignores /etc/docker/daemon.json, the registry and daemon options need a Boot2Docker URL with Docker 1.10 or later")
+	}
+
+	if err := d.checkDatastoreCapacity(); err != nil {
+		return err
+	}
+
+	if d.NetworkAuto {
+		return nil
+	}
+
+	vnet_id, err := d.networkId()
+	if err != nil {
+		return fmt.Errorf("%s, please check --opennebula-network-name and --opennebula-network-owner", err)
+	}
+
+	// Retrieving the network requires the USE permission on it
+	vnet, err := callXML("one.vn.info", vnet_id)
+	if err != nil {
+		return fmt.Errorf("Unable to use network %d: %s", vnet_id, err)
+	}
+
+	size := 0
+	iter := xmlpath.MustCompile("/VNET/AR_POOL/AR/SIZE").Iter(vnet)
+	for iter.Next() {
+		ar_size, _ := strconv.Atoi(iter.Node().String())
+		size += ar_size
+	}
+
+	used, _ := xpathString(vnet, "/VNET/USED_LEASES")
+	used_leases, _ := strconv.Atoi(used)
+
+	needed := 1
+	if d.ReserveSize > 0 {
+		needed = d.ReserveSize
+	}
+
+	if size-used_leases < needed {
+		return fmt.Errorf("Network %d has %d free leases, %d needed", vnet_id, size-used_leases, needed)
+	}
+
 	return nil
 }
 
-func (d *Driver) Create() error {
-	var (
-		err       error
-		b2d_id    uint
-		ds_id     uint64
-		b2d_image *goca.Image
-	)
+// newDisk adds a DISK vector with the tuning attributes shared by all the
+// disks of the machine
+func (d *Driver) newDisk(template *goca.TemplateBuilder) *goca.TemplateBuilderVector {
+	vector := template.NewVector("DISK")
+	if d.DiskCache != "" {
+		vector.AddValue("CACHE", d.DiskCache)
+	}
+	if d.DiskIO != "" {
+		vector.AddValue("IO", d.DiskIO)
+	}
+	if d.DiskDiscard {
+		vector.AddValue("DISCARD", "unmap")
+	}
+	for _, limit := range [][2]string{
+		{"TOTAL_BYTES_SEC", d.TotalBytesSec},
+		{"READ_BYTES_SEC", d.ReadBytesSec},
+		{"WRITE_BYTES_SEC", d.WriteBytesSec},
+		{"TOTAL_IOPS_SEC", d.TotalIOPSSec},
+		{"READ_IOPS_SEC", d.ReadIOPSSec},
+		{"WRITE_IOPS_SEC", d.WriteIOPSSec},
+	} {
+		if limit[1] != "" {
+			vector.AddValue(limit[0], limit[1])
+		}
+	}
+	for _, attr := range d.DiskAttrs {
+		kv := strings.SplitN(attr, "=", 2)
+		vector.AddValue(kv[0], templateEscape(kv[1]))
+	}
 
-	// Import Boot2Docker
-	b2d_name := fmt.Sprintf("b2d-%s", d.MachineName)
+	return vector
+}
 
-	b2d_image, err = goca.NewImageFromName(b2d_name)
+func (d *Driver) devPrefix() string {
+	if d.DevPrefix != "" {
+		return d.DevPrefix
+	}
+	return "sd"
+}
+
+// checkContextPackages looks for the CONTEXT_PACKAGES attribute marking
+// base images with the context packages installed, without them the machine
+// never gets its key and create hangs waiting for SSH
+func (d *Driver) checkContextPackages() error {
+	if d.BaseImage == "" || d.NoContext {
+		return nil
+	}
+
+	base_id, err := imageIdFromNameOrId(d.BaseImage)
 	if err != nil {
-		b2d_template := goca.NewTemplateBuilder()
-		b2d_template.AddValue("name", b2d_name)
-		b2d_template.AddValue("path", d.Boot2DockerURL)
+		return err
+	}
+
+	image, err := callXML("one.image.info", base_id)
+	if err != nil {
+		return err
+	}
+
+	if packages, ok := xpathString(image, "/IMAGE/TEMPLATE/CONTEXT_PACKAGES"); ok && strings.ToUpper(packages) != "NO" {
+		return nil
+	}
+
+	if d.RequireContext {
+		return fmt.Errorf("Image %s does not declare CONTEXT_PACKAGES, please install the OpenNebula context packages on it.", d.BaseImage)
+	}
+
+	log.Warnf("Image %s does not declare CONTEXT_PACKAGES, the machine may not be reachable over SSH without the OpenNebula context packages", d.BaseImage)
+	return nil
+}
+
+// checkDatastoreCapacity fails early when the image datastore, or every
+// system datastore, lacks the space for the disks of the machine. Images
+// imported from a URL are not accounted since their size is unknown
+func (d *Driver) checkDatastoreCapacity() error {
+	image_mb, system_mb := 0, 0
+
+	if _, err := goca.NewImageFromName(fmt.Sprintf("b2d-%s", d.MachineName)); err != nil && d.BaseImage != "" {
+		base_id, err := imageIdFromNameOrId(d.BaseImage)
+		if err != nil {
+			return err
+		}
+
+		base, err := callXML("one.image.info", base_id)
+		if err != nil {
+			return err
+		}
+
+		size, _ := xpathString(base, "/IMAGE/SIZE")
+		base_mb, _ := strconv.Atoi(size)
+		image_mb += base_mb
+	}
+
+	disk_mb, _ := strconv.Atoi(d.DiskSize)
+	if d.CDROM || d.PersistentData {
+		if _, err := goca.NewImageFromName(d.dataImageName()); err != nil {
+			image_mb += disk_mb
+		}
+	} else if (d.OSType == "boot2docker" && d.DataImageId == "" && d.DataImageName == "") || d.DataDisk {
+		system_mb += disk_mb
+	}
+
+	for _, size := range append([]string{d.OSDiskSize, d.SwapSize}, d.ExtraDiskSizes...) {
+		size_mb, _ := strconv.Atoi(size)
+		system_mb += size_mb
+	}
+
+	if image_mb > 0 {
+		ds_id, err := d.imageDatastoreId()
+		if err != nil {
+			return err
+		}
 
-		ds_id, err = strconv.ParseUint(d.DatastoreId, 10, 32)
+		ds, err := callXML("one.datastore.info", ds_id)
 		if err != nil {
 			return err
 		}
 
-		b2d_id, err = goca.CreateImage(b2d_template.String(), uint(ds_id))
+		free, _ := xpathString(ds, "/DATASTORE/FREE_MB")
+		if free_mb, err := strconv.Atoi(free); err == nil && free_mb < image_mb {
+			return fmt.Errorf("Datastore %d has %d MB free, %d MB needed for the images of the machine", ds_id, free_mb, image_mb)
+		}
+	}
+
+	if system_mb > 0 {
+		pool, err := callXML("one.datastorepool.info")
 		if err != nil {
 			return err
 		}
 
-		b2d_image = goca.NewImage(b2d_id)
+		max_mb, found := 0, false
+		iter := xmlpath.MustCompile("/DATASTORE_POOL/DATASTORE[TYPE='1']/FREE_MB").Iter(pool)
+		for iter.Next() {
+			free_mb, _ := strconv.Atoi(iter.Node().String())
+			if !found || free_mb > max_mb {
+				max_mb, found = free_mb, true
+			}
+		}
+
+		if found && max_mb < system_mb {
+			return fmt.Errorf("The system datastores have at most %d MB free, %d MB needed for the disks of the machine", max_mb, system_mb)
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) Create() (err error) {
+	var (
+		b2d_id    uint
+		b2d_image *goca.Image
+		allocated bool
+	)
+
+	if d.AttachVMId != "" {
+		return d.adoptVM()
+	}
+
+	// The resources registered by this create are removed again when it
+	// fails, latest first, so a retry starts clean
+	var rollback []func() error
+	defer func() {
+		if err == nil || len(rollback) == 0 {
+			return
+		}
+
+		log.Infof("Removing the resources of the failed create...")
+		for i := len(rollback) - 1; i >= 0; i-- {
+			if err := rollback[i](); err != nil {
+				log.Warnf("Rollback: %s", err)
+			}
+		}
+	}()
+
+	// Import Boot2Docker
+	b2d_name := fmt.Sprintf("b2d-%s", d.MachineName)
+
+	b2d_image, err = goca.NewImageFromName(b2d_name)
+	if err != nil {
+		if d.BaseImage != "" {
+			b2d_id, allocated, err = d.cloneImage(b2d_name)
+		} else {
+			b2d_id, allocated, err = d.importImage(b2d_name)
+		}
+		if err != nil {
+			return err
+		}
+		// An image registered by a concurrent create is not ours to delete
+		if allocated {
+			rollback = append(rollback, goca.NewImage(b2d_id).Delete)
+		}
+
+		log.Infof("Boot2Docker image registered...")
+	} else {
+		// The image may still be importing for a concurrent create
+		if err = d.waitForImage(b2d_image); err != nil {
+			return err
+		}
+
+		b2d_id = b2d_image.Id
+	}
+
+	// Imported images are created persistent, clones and images left
+	// by a previous attempt have to be switched afterwards
+	if d.Persistent {
+		if _, err = goca.Client().Call("one.image.persistent", b2d_id, true); err != nil {
+			return err
+		}
+	}
+
+	// The data disk of generic images goes on the bus of the OS disk,
+	// right after it, so the guest names it as the start script expects
+	data_prefix, err := d.dataDevPrefix(b2d_id)
+	if err != nil {
+		return err
+	}
+
+	if err = d.createSSHKey(); err != nil {
+		return err
+	}
+
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return err
+	}
+
+	sshKeys := []string{strings.TrimSpace(string(pubKey))}
+	for _, key := range d.SSHExtraKeys {
+		// Values naming an existing file are read, anything else is
+		// taken as the key itself
+		if _, err := os.Stat(key); err == nil {
+			content, err := ioutil.ReadFile(key)
+			if err != nil {
+				return err
+			}
+			key = string(content)
+		}
+		sshKeys = append(sshKeys, strings.TrimSpace(key))
+	}
+
+	var userData []byte
+	if d.UserDataFile != "" {
+		if userData, err = ioutil.ReadFile(d.UserDataFile); err != nil {
+			return err
+		}
+
+		if d.RenderTemplates {
+			rendered, err := d.render(string(userData))
+			if err != nil {
+				return fmt.Errorf("User data %s: %s", d.UserDataFile, err)
+			}
+			userData = []byte(rendered)
+		}
+	}
+
+	var context [][2]string
+	for _, variable := range d.Context {
+		kv := strings.SplitN(variable, "=", 2)
+		if d.RenderTemplates {
+			if kv[1], err = d.render(kv[1]); err != nil {
+				return fmt.Errorf("Context variable %s: %s", kv[0], err)
+			}
+		}
+		context = append(context, [2]string{kv[0], kv[1]})
+	}
+
+	startScript := d.StartScript
+	if d.StartScriptFile != "" {
+		script, err := ioutil.ReadFile(d.StartScriptFile)
+		if err != nil {
+			return err
+		}
+		startScript = string(script)
+	}
+
+	// Commands run at boot before the user's start script
+	var commands []string
+
+	daemonJSON, err := d.daemonJSON()
+	if err != nil {
+		return err
+	}
+	if daemonJSON != nil {
+		commands = append(commands, writeFileCommands("/etc/docker/daemon.json", daemonJSON)...)
+	}
+	commands = append(commands, d.proxyCommands()...)
+
+	// Boot2Docker mounts its data disk by itself
+	if d.genericDataDisk() {
+		device := dataDiskTarget(data_prefix)
+		if d.DataDiskPassphrase != "" {
+			commands = append(commands, luksCommands(device, "docker-data")...)
+			device = "mapper/docker-data"
+		}
+		if d.DataDisk || d.DataDiskPassphrase != "" {
+			commands = append(commands, formatCommands(device)...)
+		}
+		commands = append(commands, mountCommands(device, "/var/lib/docker")...)
+	}
+
+	// Inline files travel as context attributes the start script decodes
+	var inlineFiles [][2]string
+	for i, file := range d.InlineFiles {
+		kv := strings.SplitN(file, ":", 2)
+		content, err := ioutil.ReadFile(kv[0])
+		if err != nil {
+			return err
+		}
+
+		attr := fmt.Sprintf("INLINE_FILE_%d", i)
+		inlineFiles = append(inlineFiles, [2]string{attr, base64.StdEncoding.EncodeToString(content)})
+		commands = append(commands,
+			fmt.Sprintf("mkdir -p %s", filepath.Dir(kv[1])),
+			fmt.Sprintf("echo \"$%s\" | base64 -d > %s", attr, kv[1]))
+	}
+
+	startScript = bootScript(commands, startScript)
+
+	var files []string
+	for _, file := range d.ContextFiles {
+		file_id, err := imageIdFromNameOrId(file)
+		if err != nil {
+			return err
+		}
+		files = append(files, fmt.Sprintf("$FILE[IMAGE_ID=%d]", file_id))
+	}
+
+	// Create template
+	template := goca.NewTemplateBuilder()
+	template.AddValue("NAME", d.vmName())
+	template.AddValue("CPU", d.CPU)
+	template.AddValue("MEMORY", d.Memory)
+
+	if d.VCPU != "" {
+		template.AddValue("VCPU", d.VCPU)
+	}
+
+	if d.SchedRank != "" {
+		template.AddValue("SCHED_RANK", templateEscape(d.SchedRank))
+	}
+
+	if d.SchedDSReqs != "" {
+		template.AddValue("SCHED_DS_REQUIREMENTS", templateEscape(d.SchedDSReqs))
+	}
+
+	if d.SchedDSRank != "" {
+		template.AddValue("SCHED_DS_RANK", templateEscape(d.SchedDSRank))
+	}
+
+	if d.BackupDatastoreId != "" {
+		backup := template.NewVector("BACKUP_CONFIG")
+		backup.AddValue("MODE", d.BackupMode)
+		if d.BackupKeepLast > 0 {
+			backup.AddValue("KEEP_LAST", d.BackupKeepLast)
+		}
+
+		// REPEAT 3 is hourly, the first backup runs an interval after
+		// the machine starts
+		sched := template.NewVector("SCHED_ACTION")
+		sched.AddValue("ACTION", "backup")
+		sched.AddValue("ARGS", d.BackupDatastoreId)
+		sched.AddValue("REPEAT", 3)
+		sched.AddValue("DAYS", d.BackupInterval)
+		sched.AddValue("TIME", fmt.Sprintf("+%d", d.BackupInterval*3600))
+		sched.AddValue("END_TYPE", 0)
+	}
+
+	if d.NICDefaultModel != "" || d.NICDefaultSecGroups != "" || d.NICDefaultFilter != "" {
+		nic_default := template.NewVector("NIC_DEFAULT")
+		if d.NICDefaultModel != "" {
+			nic_default.AddValue("MODEL", d.NICDefaultModel)
+		}
+		if d.NICDefaultSecGroups != "" {
+			nic_default.AddValue("SECURITY_GROUPS", d.NICDefaultSecGroups)
+		}
+		if d.NICDefaultFilter != "" {
+			nic_default.AddValue("FILTER", d.NICDefaultFilter)
+		}
+	}
+
+	if d.ReserveSize > 0 && d.ReservationId == "" {
+		if d.ReservationId, err = d.reserveNetwork(); err != nil {
+			return err
+		}
+		rollback = append(rollback, func() error {
+			id, _ := strconv.Atoi(d.ReservationId)
+			d.ReservationId = ""
+			_, err := goca.Client().Call("one.vn.delete", id)
+			return err
+		})
+	}
+
+	vector := template.NewVector("NIC")
+	if d.ReservationId != "" {
+		vector.AddValue("NETWORK_ID", d.ReservationId)
+	} else if d.NetworkName != "" {
+		vector.AddValue("NETWORK", d.NetworkName)
+		if d.NetworkOwner != "" {
+			vector.AddValue("NETWORK_UNAME", d.NetworkOwner)
+		}
+		if d.NetworkOwnerId != "" {
+			vector.AddValue("NETWORK_UID", d.NetworkOwnerId)
+		}
+	} else if d.NetworkId != "" {
+		vector.AddValue("NETWORK_ID", d.NetworkId)
+	}
+	if d.NetworkAuto {
+		vector.AddValue("NETWORK_MODE", "auto")
+		if d.NetworkSchedReqs != "" {
+			vector.AddValue("SCHED_REQUIREMENTS", templateEscape(d.NetworkSchedReqs))
+		}
+	}
+	if d.IP != "" {
+		vector.AddValue("IP", d.IP)
+	}
+	if d.NICModel != "" {
+		vector.AddValue("MODEL", d.NICModel)
+	}
+	if d.NICFilter != "" {
+		vector.AddValue("FILTER", d.NICFilter)
+	}
+	if d.FilterIPSpoofing {
+		vector.AddValue("FILTER_IP_SPOOFING", "YES")
+	}
+	if d.FilterMACSpoofing {
+		vector.AddValue("FILTER_MAC_SPOOFING", "YES")
+	}
+	if d.VlanId != "" {
+		vector.AddValue("VLAN_ID", d.VlanId)
+	}
+	if d.PhyDev != "" {
+		vector.AddValue("PHYDEV", d.PhyDev)
+	}
+	for _, bw := range [][2]string{
+		{"INBOUND_AVG_BW", d.InboundAvgBW},
+		{"INBOUND_PEAK_BW", d.InboundPeakBW},
+		{"INBOUND_PEAK_KB", d.InboundPeakKB},
+		{"OUTBOUND_AVG_BW", d.OutboundAvgBW},
+		{"OUTBOUND_PEAK_BW", d.OutboundPeakBW},
+		{"OUTBOUND_PEAK_KB", d.OutboundPeakKB},
+	} {
+		if bw[1] != "" {
+			vector.AddValue(bw[0], bw[1])
+		}
+	}
+
+	// Aliases are secondary addresses of the first NIC, the lease of the
+	// floating IP stays with the VM across undeploy and redeploy
+	if d.FloatingNetwork != "" || d.PublicNetwork != "" || len(d.NICAliases) > 0 {
+		vector.AddValue("NAME", "NIC0")
+	}
+
+	if d.FloatingNetwork != "" {
+		vector = template.NewVector("NIC_ALIAS")
+		vector.AddValue("NETWORK", d.FloatingNetwork)
+		vector.AddValue("PARENT", "NIC0")
+		if d.FloatingIP != "" {
+			vector.AddValue("IP", d.FloatingIP)
+		}
+	}
+
+	// Elastic IPs of edge clusters are mapped by the provider outside of
+	// the hypervisor, hence EXTERNAL
+	if d.PublicNetwork != "" {
+		vector = template.NewVector("NIC_ALIAS")
+		vector.AddValue("NETWORK", d.PublicNetwork)
+		vector.AddValue("PARENT", "NIC0")
+		vector.AddValue("EXTERNAL", "YES")
+	}
+
+	for _, alias := range d.NICAliases {
+		alias_network := strings.SplitN(alias, ":", 2)
+
+		vector = template.NewVector("NIC_ALIAS")
+		vector.AddValue("NETWORK", alias_network[0])
+		vector.AddValue("PARENT", "NIC0")
+		if len(alias_network) == 2 {
+			vector.AddValue("IP", alias_network[1])
+		}
+	}
+
+	// The data NIC carries the container traffic, GetIP keeps using the
+	// first (management) NIC for SSH and the docker API
+	if d.DataNetwork != "" {
+		vector = template.NewVector("NIC")
+		if _, err := strconv.ParseUint(d.DataNetwork, 10, 32); err == nil {
+			vector.AddValue("NETWORK_ID", d.DataNetwork)
+		} else {
+			vector.AddValue("NETWORK", d.DataNetwork)
+		}
+		if d.NICModel != "" {
+			vector.AddValue("MODEL", d.NICModel)
+		}
+	}
+
+	vector = d.newDisk(template)
+	vector.AddValue("IMAGE_ID", b2d_id)
+	if d.CDROM {
+		vector.AddValue("DEV_PREFIX", "hd")
+	} else if d.OSType == "boot2docker" || d.DevPrefix != "" || d.genericDataDisk() {
+		vector.AddValue("DEV_PREFIX", data_prefix)
+	}
+	if d.OSDiskSize != "" {
+		vector.AddValue("SIZE", d.OSDiskSize)
+	}
+
+	// Boot2Docker keeps its data on a volatile disk, or on a persistent
+	// one with the CDROM layout or when asked to; generic images store
+	// everything on the OS disk
+	if d.DataImageId != "" || d.DataImageName != "" {
+		data_image := d.DataImageId
+		if d.DataImageName != "" {
+			data_image = d.DataImageName
+		}
+
+		data_id, err := imageIdFromNameOrId(data_image)
+		if err != nil {
+			return err
+		}
+
+		vector = d.newDisk(template)
+		vector.AddValue("IMAGE_ID", data_id)
+		vector.AddValue("DEV_PREFIX", data_prefix)
+		if d.OSType == "generic" {
+			vector.AddValue("TARGET", dataDiskTarget(data_prefix))
+		}
+	} else if d.CDROM || d.PersistentData {
+		data_id, allocated, err := d.dataImage(d.dataImageName())
+		if err != nil {
+			return err
+		}
+		// A datablock kept from a removed machine holds its data
+		if allocated {
+			rollback = append(rollback, goca.NewImage(data_id).Delete)
+		}
+
+		vector = d.newDisk(template)
+		vector.AddValue("IMAGE_ID", data_id)
+		vector.AddValue("DEV_PREFIX", d.devPrefix())
+
+		if d.CDROM {
+			vector = template.NewVector("OS")
+			vector.AddValue("BOOT", "cdrom")
+		}
+	} else if d.OSType == "boot2docker" || d.DataDisk {
+		vector = d.newDisk(template)
+		if d.DiskFormat != "default" {
+			vector.AddValue("FORMAT", d.DiskFormat)
+		}
+		vector.AddValue("TYPE", "fs")
+		if d.DiskFS != "" {
+			vector.AddValue("FS", d.DiskFS)
+		}
+		vector.AddValue("SIZE", string(d.DiskSize))
+		vector.AddValue("DEV_PREFIX", data_prefix)
+		if d.DataDisk {
+			vector.AddValue("TARGET", dataDiskTarget(data_prefix))
+		}
+	}
+
+	if d.SwapSize != "" {
+		vector = d.newDisk(template)
+		vector.AddValue("TYPE", "swap")
+		vector.AddValue("SIZE", d.SwapSize)
+		vector.AddValue("DEV_PREFIX", d.devPrefix())
+	}
+
+	for _, size := range d.ExtraDiskSizes {
+		vector = d.newDisk(template)
+		if d.DiskFormat != "default" {
+			vector.AddValue("FORMAT", d.DiskFormat)
+		}
+		vector.AddValue("TYPE", "fs")
+		if d.DiskFS != "" {
+			vector.AddValue("FS", d.DiskFS)
+		}
+		vector.AddValue("SIZE", size)
+		vector.AddValue("DEV_PREFIX", d.devPrefix())
+	}
+	for _, image := range d.ExtraDiskImages {
+		image_id, err := imageIdFromNameOrId(image)
+		if err != nil {
+			return err
+		}
+
+		vector = d.newDisk(template)
+		vector.AddValue("IMAGE_ID", image_id)
+		vector.AddValue("DEV_PREFIX", d.devPrefix())
+	}
+
+	// Appliances with a baked configuration boot without context
+	if !d.NoContext {
+		vector = template.NewVector("CONTEXT")
+		vector.AddValue("NETWORK", "YES")
+		vector.AddValue("SSH_PUBLIC_KEY", templateEscape(strings.Join(sshKeys, "\n")))
+		if d.Hostname != "" {
+			vector.AddValue("SET_HOSTNAME", d.Hostname)
+		} else {
+			vector.AddValue("SET_HOSTNAME", d.MachineName)
+		}
+		if d.StaticIP != "" {
+			vector.AddValue("ETH0_IP", d.StaticIP)
+			if d.StaticMask != "" {
+				vector.AddValue("ETH0_MASK", d.StaticMask)
+			}
+		}
+		if d.DNS != "" {
+			vector.AddValue("ETH0_DNS", d.DNS)
+		}
+		if d.Gateway != "" {
+			vector.AddValue("ETH0_GATEWAY", d.Gateway)
+		}
+		if d.SearchDomain != "" {
+			vector.AddValue("ETH0_SEARCH_DOMAIN", d.SearchDomain)
+		}
+		if d.OSType == "generic" && d.SSHUser != "root" {
+			vector.AddValue("USERNAME", d.SSHUser)
+		}
+		if userData != nil {
+			vector.AddValue("USER_DATA", base64.StdEncoding.EncodeToString(userData))
+			vector.AddValue("USERDATA_ENCODING", "base64")
+		}
+		if startScript != "" {
+			vector.AddValue("START_SCRIPT_BASE64", base64.StdEncoding.EncodeToString([]byte(startScript)))
+		}
+		if len(files) > 0 {
+			vector.AddValue("FILES_DS", strings.Join(files, " "))
+		}
+		for _, file := range inlineFiles {
+			vector.AddValue(file[0], file[1])
+		}
+		devs, routes, _ := d.routes()
+		for _, dev := range devs {
+			vector.AddValue(dev+"_ROUTES", strings.Join(routes[dev], ", "))
+		}
+		if d.NoGrowFS {
+			vector.AddValue("GROW_ROOTFS", "NO")
+			vector.AddValue("GROW_FS", "")
+		} else if d.GrowFS != "" {
+			vector.AddValue("GROW_ROOTFS", "YES")
+			vector.AddValue("GROW_FS", d.GrowFS)
+		}
+		if d.NTPServer != "" {
+			vector.AddValue("NTP_SERVER", d.NTPServer)
+		}
+		if d.Timezone != "" {
+			vector.AddValue("TIMEZONE", d.Timezone)
+		}
+		if d.DataDiskPassphrase != "" {
+			vector.AddValue("LUKS_PASSPHRASE", templateEscape(d.DataDiskPassphrase))
+		}
+		if d.CryptedPassword != "" {
+			vector.AddValue("CRYPTED_PASSWORD", templateEscape(d.CryptedPassword))
+		} else if d.Password != "" {
+			vector.AddValue("PASSWORD", templateEscape(d.Password))
+		}
+		if d.OneGate || d.readyWait() != "ssh" {
+			vector.AddValue("TOKEN", "YES")
+		}
+		if d.readyWait() != "ssh" {
+			vector.AddValue("REPORT_READY", "YES")
+		}
+		for _, v := range d.swarmMetadata() {
+			vector.AddValue(v[0], v[1])
+		}
+		for _, v := range context {
+			vector.AddValue(v[0], templateEscape(v[1]))
+		}
+	}
+
+	// Attributes of the user template are served by OneGate too
+	if d.OneGate {
+		for _, v := range d.swarmMetadata() {
+			template.AddValue(v[0], v[1])
+		}
+	}
+
+	vector = template.NewVector("GRAPHICS")
+	vector.AddValue("LISTEN", "0.0.0.0")
+	vector.AddValue("TYPE", "vnc")
+
+	// Instantiate
+	log.Infof("Starting  VM...")
+	vm_id, err := goca.CreateVM(template.String(), false)
+	if err != nil {
+		return err
+	}
+	rollback = append(rollback, func() error {
+		return d.terminate(goca.NewVM(vm_id))
+	})
+
+	// A concurrent create may have picked the same name in the meantime
+	if _, err = goca.NewVMFromName(d.vmName()); err != nil && !isNotFound(err) && d.UniqueName {
+		if d.VMName, err = uniqueVMName(d.MachineName); err != nil {
+			return err
+		}
+
+		log.Infof("Renaming VM to %s...", d.VMName)
+		if _, err = goca.Client().Call("one.vm.rename", vm_id, d.VMName); err != nil {
+			return err
+		}
+	}
+
+	if d.IPAddress, err = d.waitForIP(); err != nil {
+		return err
+	}
+
+	if err := d.Start(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// vmName is the name of the VM of the machine, which the driver looks the VM
+// up by. It is the machine name unless --opennebula-unique-name picked another
+func (d *Driver) vmName() string {
+	if d.VMName != "" {
+		return d.VMName
+	}
+	return d.MachineName
+}
+
+// checkVMName makes sure no other VM of the user has the name of the
+// machine, as the driver would act on it instead
+func (d *Driver) checkVMName() error {
+	_, err := goca.NewVMFromName(d.vmName())
+	if err != nil && isNotFound(err) {
+		return nil
+	}
+	if err != nil && err.Error() != "Multiple resources with that name." {
+		return err
+	}
+
+	if !d.UniqueName {
+		return fmt.Errorf("A VM named %s already exists, please remove it or use --opennebula-unique-name.", d.vmName())
+	}
+
+	d.VMName, err = uniqueVMName(d.MachineName)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("A VM named %s already exists, the VM will be named %s", d.MachineName, d.VMName)
+	return nil
+}
+
+// uniqueVMName returns the first name from <name>-1 not used by a VM
+func uniqueVMName(name string) (string, error) {
+	for n := 1; n <= nameRetries; n++ {
+		candidate := fmt.Sprintf("%s-%d", name, n)
+		_, err := goca.NewVMFromName(candidate)
+		if err != nil && isNotFound(err) {
+			return candidate, nil
+		}
+		if err != nil && err.Error() != "Multiple resources with that name." {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("No free name for the VM of %s", name)
+}
+
+// createSSHKey imports --opennebula-ssh-key as the machine key, or
+// generates a new one
+func (d *Driver) createSSHKey() error {
+	if d.SSHKey != "" {
+		log.Infof("Importing SSH key...")
+		if err := mcnutils.CopyFile(d.SSHKey, d.GetSSHKeyPath()); err != nil {
+			return err
+		}
+		return mcnutils.CopyFile(d.SSHKey+".pub", d.publicSSHKeyPath())
+	}
+
+	log.Infof("Creating SSH key...")
+	return ssh.GenerateSSHKey(d.GetSSHKeyPath())
+}
+
+// adoptVM takes over the VM given by --opennebula-attach-vm-id: the VM is
+// renamed after the machine, as the driver looks it up by name, and the
+// machine key is added to its context. Running VMs are rebooted so the
+// guest applies the new context
+func (d *Driver) adoptVM() error {
+	id, err := strconv.ParseUint(d.AttachVMId, 10, 32)
+	if err != nil {
+		return err
+	}
+
+	vm := goca.NewVM(uint(id))
+	if err = vm.Info(); err != nil {
+		return err
+	}
+
+	if err = d.createSSHKey(); err != nil {
+		return err
+	}
+
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Adding the machine key to VM %d...", vm.Id)
+	err = updateContextKeys(vm, func(keys string) string {
+		if keys == "" {
+			return strings.TrimSpace(string(pubKey))
+		}
+		return keys + "\n" + strings.TrimSpace(string(pubKey))
+	})
+	if err != nil {
+		return err
+	}
+
+	if name, _ := vm.XPath("/VM/NAME"); name != d.vmName() {
+		log.Infof("Renaming VM %s to %s...", name, d.vmName())
+		if _, err = goca.Client().Call("one.vm.rename", vm.Id, d.vmName()); err != nil {
+			return err
+		}
+	}
+
+	if d.IPAddress, err = d.waitForIP(); err != nil {
+		return err
+	}
+
+	if vm_state, _, _ := vmStateString(vm); vm_state == "ACTIVE" {
+		return d.Restart()
+	}
+
+	return d.Start()
+}
+
+func (d *Driver) GetURL() (string, error) {
+	if d.DockerURLHost != "" {
+		return fmt.Sprintf("tcp://%s", net.JoinHostPort(d.DockerURLHost, "2376")), nil
+	}
+
+	ip, err := d.getIP(d.DockerIPFamily)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, "2376")), nil
+}
+
+func (d *Driver) GetIP() (string, error) {
+	return d.getIP("")
+}
+
+// getIP returns the address of the machine; on dual-stack NICs family
+// ("ipv4" or "ipv6") selects the lease used, by default IPv4 unless
+// --opennebula-ipv6 is set. Only the default address is stored in IPAddress
+func (d *Driver) getIP(family string) (string, error) {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return "", err
+	}
+
+	err = vm.Info()
+	if err != nil {
+		return "", err
+	}
+
+	nic := "/VM/TEMPLATE/NIC[1]"
+	if d.SSHNetwork != "" {
+		var ok bool
+		if nic, ok = vectorPath(vm, "/VM/TEMPLATE/NIC", "NETWORK", d.SSHNetwork); !ok {
+			nic, ok = vectorPath(vm, "/VM/TEMPLATE/NIC", "NETWORK_ID", d.SSHNetwork)
+		}
+		if !ok {
+			return "", fmt.Errorf("No NIC attached to network %s", d.SSHNetwork)
+		}
+	}
+
+	// An external address, e.g. the public side of a NAT, takes
+	// precedence over the lease
+	if d.ExternalIPAttr != "" {
+		for _, path := range []string{nic, "/VM/USER_TEMPLATE"} {
+			if ip, ok := vm.XPath(path + "/" + d.ExternalIPAttr); ok && ip != "" {
+				d.IPAddress = ip
+				return d.IPAddress, nil
+			}
+		}
+	}
+
+	if d.PublicNetwork != "" {
+		if ip, ok := vm.XPath("/VM/TEMPLATE/NIC_ALIAS[EXTERNAL='YES']/IP"); ok && ip != "" {
+			d.IPAddress = ip
+			return d.IPAddress, nil
+		}
+	}
+
+	if d.FloatingNetwork != "" {
+		if alias, ok := vectorPath(vm, "/VM/TEMPLATE/NIC_ALIAS", "NETWORK", d.FloatingNetwork); ok {
+			if ip, ok := vm.XPath(alias + "/IP"); ok && ip != "" {
+				d.IPAddress = ip
+				return d.IPAddress, nil
+			}
+		}
+	}
+
+	ip4, _ := vm.XPath(nic + "/IP")
+
+	ip6 := ""
+	for _, attr := range []string{"IP6_GLOBAL", "IP6", "IP6_ULA"} {
+		if ip, ok := vm.XPath(nic + "/" + attr); ok && ip != "" {
+			ip6 = ip
+			break
+		}
+	}
+
+	prefer_ipv6 := d.PreferIPv6
+	if family != "" {
+		prefer_ipv6 = family == "ipv6"
+	}
+
+	ip := ""
+	if ip6 != "" && (prefer_ipv6 || ip4 == "") {
+		ip = ip6
+	} else if ip4 != "" {
+		ip = ip4
+	} else if d.StaticIP != "" {
+		// The network has no address ranges, the guest configures
+		// the address given through the context
+		ip = d.StaticIP
+	} else {
+		ip = guestIP(vm, prefer_ipv6)
+	}
+
+	if ip == "" {
+		ip = d.IPAddress
+	} else if family == "" {
+		d.IPAddress = ip
+	}
+
+	if ip == "" {
+		return "", fmt.Errorf("IP address is not set")
+	}
+
+	return ip, nil
+}
+
+// vectorPath returns the path of the first of the vectors at path, e.g. the
+// NICs, whose attr is value. The values are compared here as they could break
+// an XPath predicate
+func vectorPath(vm *goca.VM, path, attr, value string) (string, bool) {
+	iter := vm.XPathIter(path)
+	for i := 1; iter.Next(); i++ {
+		if v, _ := iter.Node().XPathNode(attr); v == value {
+			return fmt.Sprintf("%s[%d]", path, i), true
+		}
+	}
+	return "", false
+}
+
+// guestIP returns the address reported by the guest agent through the VM
+// monitoring, for NICs whose address is leased by an external DHCP server
+func guestIP(vm *goca.VM, prefer_ipv6 bool) string {
+	addresses, _ := vm.XPath("/VM/MONITORING/GUEST_IP_ADDRESSES")
+
+	ip := ""
+	for _, address := range strings.Split(addresses, ",") {
+		parsed := net.ParseIP(strings.TrimSpace(address))
+		if parsed == nil || parsed.IsLoopback() || parsed.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if (parsed.To4() == nil) == prefer_ipv6 {
+			return parsed.String()
+		}
+		if ip == "" {
+			ip = parsed.String()
+		}
+	}
+
+	if ip == "" {
+		ip, _ = vm.XPath("/VM/MONITORING/GUEST_IP")
+	}
+
+	return ip
+}
+
+// waitForIP polls the VM until an address is assigned to it, as some
+// networks lease addresses a while after the VM is allocated
+func (d *Driver) waitForIP() (string, error) {
+	start := time.Now()
+	poll := d.newBackoff()
+	for {
+		ip, err := d.GetIP()
+		if err == nil {
+			return ip, nil
+		}
+
+		if time.Since(start) > time.Duration(d.ipTimeout())*time.Second {
+			return "", err
+		}
+
+		poll.Sleep()
+	}
+}
+
+func (d *Driver) GetState() (state.State, error) {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		// Half created or already removed machines have no VM, that
+		// is not an error for ls and rm -f
+		if isNotFound(err) {
+			return state.None, nil
+		}
+		return state.None, err
+	}
+
+	err = vm.Info()
+	if err != nil {
+		return state.None, err
+	}
+
+	vm_state, lcm_state, err := vmStateString(vm)
+	if err != nil {
+		return state.None, err
+	}
+
+	switch vm_state {
+	case "INIT", "PENDING", "HOLD":
+		return state.Starting, nil
+	case "ACTIVE":
+		switch lcm_state {
+		case "RUNNING",
+			"DISK_SNAPSHOT",
+			"DISK_SNAPSHOT_REVERT",
+			"DISK_SNAPSHOT_DELETE",
+			"HOTPLUG",
+			"HOTPLUG_SNAPSHOT",
+			"HOTPLUG_NIC",
+			"HOTPLUG_SAVEAS",
+			"HOTPLUG_RESIZE",
+			"DISK_RESIZE",
+			"BACKUP":
+			return state.Running, nil
+		case "PROLOG",
+			"BOOT",
+			"MIGRATE",
+			"PROLOG_MIGRATE",
+			"PROLOG_RESUME",
+			"CLEANUP_RESUBMIT",
+			"BOOT_UNKNOWN",
+			"BOOT_POWEROFF",
+			"BOOT_SUSPENDED",
+			"BOOT_STOPPED",
+			"PROLOG_UNDEPLOY",
+			"BOOT_UNDEPLOY",
+			"BOOT_MIGRATE",
+			"PROLOG_MIGRATE_SUSPEND",
+			"SAVE_MIGRATE",
+			"PROLOG_MIGRATE_UNKNOWN":
+			return state.Starting, nil
+		case "HOTPLUG_SAVEAS_POWEROFF",
+			"DISK_SNAPSHOT_POWEROFF",
+			"DISK_SNAPSHOT_REVERT_POWEROFF",
+			"DISK_SNAPSHOT_DELETE_POWEROFF",
+			"HOTPLUG_PROLOG_POWEROFF",
+			"HOTPLUG_EPILOG_POWEROFF",
+			"PROLOG_MIGRATE_POWEROFF",
+			"DISK_RESIZE_POWEROFF",
+			"DISK_RESIZE_UNDEPLOYED",
+			"HOTPLUG_NIC_POWEROFF",
+			"HOTPLUG_SAVEAS_UNDEPLOYED",
+			"HOTPLUG_SAVEAS_STOPPED",
+			"BACKUP_POWEROFF",
+			"SAVE_STOP":
+			return state.Stopped, nil
+		case "HOTPLUG_SAVEAS_SUSPENDED",
+			"DISK_SNAPSHOT_SUSPENDED",
+			"DISK_SNAPSHOT_REVERT_SUSPENDED",
+			"DISK_SNAPSHOT_DELETE_SUSPENDED":
+			return state.Saved, nil
+		case "EPILOG_STOP",
+			"EPILOG",
+			"SHUTDOWN_UNDEPLOY",
+			"EPILOG_UNDEPLOY",
+			"SAVE_SUSPEND",
+			"SHUTDOWN",
+			"SHUTDOWN_POWEROFF",
+			"CANCEL",
+			"CLEANUP_DELETE":
+			return state.Stopping, nil
+		case "UNKNOWN",
+			"FAILURE",
+			"BOOT_FAILURE",
+			"BOOT_MIGRATE_FAILURE",
+			"PROLOG_MIGRATE_FAILURE",
+			"PROLOG_FAILURE",
+			"EPILOG_FAILURE",
+			"EPILOG_STOP_FAILURE",
+			"EPILOG_UNDEPLOY_FAILURE",
+			"PROLOG_MIGRATE_POWEROFF_FAILURE",
+			"PROLOG_MIGRATE_SUSPEND_FAILURE",
+			"BOOT_UNDEPLOY_FAILURE",
+			"BOOT_STOPPED_FAILURE",
+			"PROLOG_RESUME_FAILURE",
+			"PROLOG_UNDEPLOY_FAILURE",
+			"PROLOG_MIGRATE_UNKNOWN_FAILURE":
+			return state.Error, nil
+		}
+
+		// Transient states of OpenNebula versions newer than the driver
+		log.Debugf("Unknown LCM state %s", lcm_state)
+		return state.None, nil
+	case "POWEROFF", "UNDEPLOYED":
+		return state.Stopped, nil
+	case "STOPPED", "SUSPENDED":
+		return state.Saved, nil
+	case "DONE", "FAILED":
+		return state.Error, nil
+	}
+
+	return state.Error, nil
+}
+
+func (d *Driver) Start() error {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return err
+	}
+
+	if err = d.upgrade(vm); err != nil {
+		return err
+	}
+
+	if err = vm.Info(); err != nil {
+		return err
+	}
+
+	vm_state, _, err := vmStateString(vm)
+	if err != nil {
+		return err
+	}
+
+	// READY is left in the user template by the previous boot
+	if d.readyWait() != "ssh" && vm_state != "ACTIVE" {
+		if _, err = goca.Client().Call("one.vm.update", vm.Id, "READY=NO", 1); err != nil {
+			return err
+		}
+	}
+
+	switch vm_state {
+	case "HOLD":
+		log.Infof("Releasing the VM from hold...")
+		if err = vm.Action("release"); err != nil {
+			return err
+		}
+	case "PENDING", "ACTIVE":
+		// Pending VMs are deployed by the scheduler, active ones are
+		// already running or booting
+	case "POWEROFF", "SUSPENDED":
+		log.Infof("Resuming the %s VM...", vm_state)
+		if err = vm.Resume(); err != nil {
+			return err
+		}
+	case "STOPPED", "UNDEPLOYED":
+		// They go back through the scheduler and may land on another host
+		log.Infof("Deploying the %s VM again...", vm_state)
+		if err = vm.Resume(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("The VM is %s, it cannot be started", vm_state)
+	}
+
+	s := state.None
+	deadline := time.Now().Add(time.Duration(d.bootTimeout()) * time.Second)
+	poll := d.newBackoff()
+	recovers := 0
+	var pending time.Time
+	for s != state.Running && time.Now().Before(deadline) {
+		s, err = d.GetState()
+		if err != nil {
+			return err
+		}
+
+		switch s {
+		case state.Running:
+		case state.Starting:
+			if err = vm.Info(); err != nil {
+				return err
+			}
+
+			// The scheduler explains why it can't place the VM, e.g. no
+			// host with enough capacity or matching the requirements
+			if vm_state, _, _ = vmStateString(vm); vm_state != "PENDING" {
+				pending = time.Time{}
+			} else if pending.IsZero() {
+				pending = time.Now()
+			} else if msg, _ := vm.XPath("/VM/USER_TEMPLATE/SCHED_MESSAGE"); msg != "" &&
+				time.Since(pending) > time.Duration(d.pendingTimeout())*time.Second {
+				return fmt.Errorf("The scheduler could not place the VM: %s", msg)
+			}
+			poll.Sleep()
+		case state.Error:
+			if err = vm.Info(); err != nil {
+				return err
+			}
+
+			// Failed prolog or boot steps are often transient datastore
+			// or network errors, retrying them usually succeeds
+			_, lcm_state, _ := vmStateString(vm)
+			if !strings.HasSuffix(lcm_state, "_FAILURE") || recovers == d.RecoverRetries {
+				return fmt.Errorf("VM in error state %s%s", lcm_state, vmMessages(vm))
+			}
+
+			recovers++
+			log.Infof("VM in %s state%s, retrying (%d/%d)...", lcm_state, vmMessages(vm), recovers, d.RecoverRetries)
+			// Recover operation 2 retries the failed action
+			if _, err = goca.Client().Call("one.vm.recover", vm.Id, 2); err != nil {
+				return err
+			}
+			// Until the retry starts the VM still reads as failed
+			if err = d.waitForLCMChange(vm, lcm_state); err != nil {
+				return err
+			}
+			deadline = time.Now().Add(time.Duration(d.bootTimeout()) * time.Second)
+			poll = d.newBackoff()
+		default:
+			poll.Sleep()
+		}
+	}
+
+	if s != state.Running {
+		if err = vm.Info(); err != nil {
+			return err
+		}
+
+		switch vm_state, _, _ = vmStateString(vm); vm_state {
+		case "PENDING":
+			return errors.New("The VM is still PENDING, the scheduler could not find a host with enough capacity for it")
+		case "HOLD":
+			return errors.New("The VM is on HOLD, it has to be released to be deployed")
+		}
+		return fmt.Errorf("Timeout waiting for the VM to run, it is %s%s", vm_state, vmMessages(vm))
+	}
+
+	if err = d.refreshIP(); err != nil {
+		return err
+	}
+
+	if d.Password != "" {
+		log.Infof("Authorizing the machine key...")
+		if err := mcnutils.WaitFor(d.provisionSSHKey); err != nil {
+			if d.hostKeyErr != nil {
+				return d.hostKeyErr
+			}
+			return errors.New("Too many retries waiting for the password authentication to succeed")
+		}
+	}
+
+	if d.readyWait() != "ssh" {
+		if err = d.waitForReady(vm); err != nil {
+			return err
+		}
+		if d.readyWait() == "onegate" {
+			return nil
+		}
+	}
+
+	log.Infof("Waiting for SSH...")
+	// Wait for SSH over NAT to be available before returning to user
+	if d.SSHBastionHost != "" || d.SSHHostKeyCheck {
+		if err := mcnutils.WaitFor(d.sshAvailable); err != nil {
+			if d.hostKeyErr != nil {
+				return d.hostKeyErr
+			}
+			return errors.New("Too many retries waiting for SSH to be available")
+		}
+	} else if err := drivers.WaitForSSH(d); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *Driver) Stop() error {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return err
+	}
+
+	// A suspended VM is checkpointed with its memory and reported as
+	// Saved, Start resumes it with the containers still running
+	if d.StopSuspends {
+		log.Infof("Suspending the machine...")
+		if err = vm.Action("suspend"); err != nil {
+			return err
+		}
+		return d.waitForState(state.Saved)
+	}
+
+	// goca's PowerOff is a hard one, the guest only gets the ACPI signal
+	// with the plain action. Undeploying also frees the host
+	action := "poweroff"
+	if d.StopUndeploys {
+		action = "undeploy"
+	}
+
+	if err = vm.Action(action); err != nil {
+		return err
+	}
+
+	// Give the containers a chance to stop before pulling the plug
+	deadline := time.Now().Add(time.Duration(d.stopGracePeriod()) * time.Second)
+	poll := d.newBackoff()
+	for time.Now().Before(deadline) {
+		s, err := d.GetState()
+		if err != nil {
+			return err
+		}
+
+		if s == state.Stopped {
+			return nil
+		}
+
+		poll.Sleep()
+	}
+
+	log.Infof("The machine did not power off in %d seconds, powering off hard...", d.stopGracePeriod())
+	if err = vm.Action(action + "-hard"); err != nil {
+		return err
+	}
+
+	return d.waitForState(state.Stopped)
+}
+
+func (d *Driver) Remove() error {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if err != nil {
+		// Deleted out of band, the other resources may still be there
+		log.Infof("VM %s not found, it was already removed", d.MachineName)
+	} else if err = d.terminate(vm); err != nil {
+		return err
+	}
+
+	if d.CDROM || d.PersistentData {
+		log.Infof("Keeping the data disk %s, delete the image to free it", d.dataImageName())
+	}
+
+	// The OS image was created by the driver for this machine only
+	b2d_name := fmt.Sprintf("b2d-%s", d.MachineName)
+	if b2d_image, err := goca.NewImageFromName(b2d_name); err == nil {
+		log.Infof("Deleting image %s...", b2d_name)
+		if err = b2d_image.Delete(); err != nil {
+			return err
+		}
+	}
+
+	if d.ReservationId != "" {
+		id, _ := strconv.Atoi(d.ReservationId)
+		if _, err = goca.Client().Call("one.vn.delete", id); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) Restart() error {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return err
+	}
+
+	rebooted := time.Now()
+	err = vm.Reboot()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Waiting for the machine to reboot...")
+	if err := mcnutils.WaitFor(func() bool { return d.bootedSince(rebooted) }); err != nil {
+		if d.hostKeyErr != nil {
+			return d.hostKeyErr
+		}
+		return errors.New("Too many retries waiting for the machine to reboot")
+	}
+
+	return d.refreshIP()
+}
+
+// refreshIP resolves the address of the machine again, as redeploys and DHCP
+// may change it, and updates the one stored in the machine config
+func (d *Driver) refreshIP() error {
+	// getIP stores the default address itself, compare with the old one
+	previous := d.IPAddress
+	ip, err := d.waitForIP()
+	if err != nil {
+		return err
+	}
+
+	if previous != "" && ip != previous {
+		log.Infof("The address of %s changed from %s to %s", d.MachineName, previous, ip)
+	}
+	d.IPAddress = ip
+
+	return nil
+}
+
+// terminate deletes the VM and waits for it to be DONE
+func (d *Driver) terminate(vm *goca.VM) error {
+	// terminate-hard is the action of OpenNebula 5 and later, older
+	// versions call it shutdown-hard
+	if err := vm.Action("terminate-hard"); err != nil {
+		if err = vm.ShutdownHard(); err != nil {
+			return err
+		}
+	}
+
+	// The images and the reserved leases are only released once the VM
+	// is DONE
+	return d.waitForVMState(vm, "DONE")
+}
+
+func (d *Driver) Kill() error {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return err
+	}
+
+	if err = d.snapshotDisks(vm, "kill"); err != nil {
+		return err
+	}
+
+	err = vm.PowerOffHard()
+	if err != nil {
+		return err
+	}
+
+	// Don't report back before OpenNebula has actually powered it off
+	return d.waitForState(state.Stopped)
+}
+
+// vmMessages formats the ERROR and SCHED_MESSAGE oned and the scheduler
+// leave in the user template of the VM, for the errors reporting its state
+func vmMessages(vm *goca.VM) string {
+	var messages []string
+	for _, attr := range []string{"ERROR", "SCHED_MESSAGE"} {
+		if msg, ok := vm.XPath("/VM/USER_TEMPLATE/" + attr); ok && msg != "" {
+			messages = append(messages, fmt.Sprintf("%s: %s", attr, msg))
+		}
+	}
+
+	if len(messages) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(messages, ", ") + ")"
+}
+
+// readyWait is the --opennebula-ready-wait of the machine, ssh for machines
+// created before the option existed
+func (d *Driver) readyWait() string {
+	if d.ReadyWait == "" {
+		return defaultReadyWait
+	}
+	return d.ReadyWait
+}
+
+// ipTimeout, bootTimeout, pendingTimeout and stopTimeout are the timeouts of
+// the machine in seconds, the defaults for machines created before the
+// options existed
+func (d *Driver) ipTimeout() int {
+	if d.IPTimeout == 0 {
+		return defaultIPTimeout
+	}
+	return d.IPTimeout
+}
+
+func (d *Driver) bootTimeout() int {
+	if d.BootTimeout == 0 {
+		return defaultBootTimeout
+	}
+	return d.BootTimeout
+}
+
+func (d *Driver) pendingTimeout() int {
+	if d.PendingTimeout == 0 {
+		return defaultPendingTimeout
+	}
+	return d.PendingTimeout
+}
+
+func (d *Driver) stopTimeout() int {
+	if d.StopTimeout == 0 {
+		return defaultStopTimeout
+	}
+	return d.StopTimeout
+}
+
+// pollMaxInterval is the --opennebula-poll-max-interval of the machine, the
+// default for machines created before the option existed
+func (d *Driver) pollMaxInterval() int {
+	if d.PollMaxInterval == 0 {
+		return defaultPollMaxInterval
+	}
+	return d.PollMaxInterval
+}
+
+// waitForReady polls the user template of the VM until the guest reports
+// READY=YES through OneGate, once its context has been applied
+func (d *Driver) waitForReady(vm *goca.VM) error {
+	log.Infof("Waiting for the machine to report READY...")
+	deadline := time.Now().Add(time.Duration(d.bootTimeout()) * time.Second)
+	poll := d.newBackoff()
+	for time.Now().Before(deadline) {
+		if err := vm.Info(); err != nil {
+			return err
+		}
+
+		if ready, _ := vm.XPath("/VM/USER_TEMPLATE/READY"); strings.ToUpper(ready) == "YES" {
+			return nil
+		}
+
+		poll.Sleep()
+	}
+
+	return fmt.Errorf("Timeout waiting for the machine to report READY after %d seconds", d.bootTimeout())
+}
+
+// stopGracePeriod is the --opennebula-stop-grace-period of the machine, the
+// default for machines created before the option existed
+func (d *Driver) stopGracePeriod() int {
+	if d.StopGracePeriod == 0 {
+		return defaultStopGracePeriod
+	}
+	return d.StopGracePeriod
+}
+
+// waitForState polls the machine state until it is target, Stopped or Saved,
+// for at most --opennebula-stop-timeout seconds
+func (d *Driver) waitForState(target state.State) error {
+	deadline := time.Now().Add(time.Duration(d.stopTimeout()) * time.Second)
+	poll := d.newBackoff()
+	for time.Now().Before(deadline) {
+		s, err := d.GetState()
+		if err != nil {
+			return err
+		}
+
+		if s == target {
+			return nil
+		}
+
+		poll.Sleep()
+	}
+
+	return fmt.Errorf("Timeout waiting for the VM to be %s after %d seconds", target, d.stopTimeout())
+}
+
+// SaveDiskAs copies the OS disk of the machine into a new image with the
+// given name, so it can be used as --opennebula-base-image by later creates
+func (d *Driver) SaveDiskAs(name string) (uint, error) {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return 0, err
+	}
+
+	if err = vm.Info(); err != nil {
+		return 0, err
+	}
+
+	disk_id, ok := vm.XPath("/VM/TEMPLATE/DISK/DISK_ID")
+	if !ok {
+		return 0, errors.New("Unable to find the OS disk of the VM")
+	}
+
+	id, _ := strconv.Atoi(disk_id)
+	response, err := goca.Client().Call("one.vm.disksaveas", vm.Id, id, name, "", -1)
+	if err != nil {
+		return 0, err
+	}
+
+	image_id := uint(response.BodyInt())
+	log.Infof("Saving disk of %s as image %s...", d.MachineName, name)
+	if err = d.waitForImage(goca.NewImage(image_id)); err != nil {
+		return 0, err
+	}
+
+	return image_id, nil
+}
+
+// growFSScript grows the last partition of the device, if any, and the
+// filesystem on it
+const growFSScript = `dev=/dev/%s
+part=$(lsblk -lnpo NAME,TYPE $dev | awk '$2 == "part" { p = $1 } END { print p }')
+if [ -n "$part" ]; then
+  growpart $dev $(echo $part | sed 's/.*[^0-9]//') || true
+  dev=$part
+fi
+case $(lsblk -no FSTYPE $dev) in
+  xfs) xfs_growfs $(lsblk -no MOUNTPOINT $dev) ;;
+  ext*) resize2fs $dev ;;
+esac`
+
+// ResizeDisk grows a disk of the machine to size MB and, when the machine
+// is running, the filesystem on it
+func (d *Driver) ResizeDisk(diskId int, size string) error {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return err
+	}
+
+	if err = vm.Info(); err != nil {
+		return err
+	}
+
+	vm_state, lcm_state, err := vmStateString(vm)
+	if err != nil {
+		return err
+	}
+
+	target, ok := vm.XPath(fmt.Sprintf("/VM/TEMPLATE/DISK[DISK_ID='%d']/TARGET", diskId))
+	if !ok {
+		return fmt.Errorf("Unable to find disk %d of the VM", diskId)
+	}
+
+	log.Infof("Resizing disk %d of %s to %s MB...", diskId, d.MachineName, size)
+	if _, err = goca.Client().Call("one.vm.diskresize", vm.Id, diskId, size); err != nil {
+		return err
+	}
+
+	if err = d.waitForLCMState(vm, lcm_state); err != nil {
+		return err
+	}
+
+	// Stopped machines grow their filesystems on boot with GROW_FS
+	if vm_state != "ACTIVE" || lcm_state != "RUNNING" {
+		return nil
+	}
+
+	machine_config, err := sshClientConfig(d.SSHUser, d.GetSSHKeyPath())
+	if err != nil {
+		return err
+	}
+
+	shell := "sh"
+	if d.SSHUser != "root" {
+		shell = "sudo sh"
+	}
+	script := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(growFSScript, target)))
+	command := fmt.Sprintf("echo %s | base64 -d | %s", script, shell)
+
+	log.Infof("Growing the filesystem of %s...", target)
+	if err = d.sshRun(machine_config, command); err != nil {
+		return fmt.Errorf("Disk %d resized but its filesystem could not be grown: %s", diskId, err)
+	}
+
+	return nil
+}
+
+// AttachVolatileDisk hot-attaches a new volatile disk of size MB and
+// returns its DISK_ID
+func (d *Driver) AttachVolatileDisk(size string) (int, error) {
+	disk := goca.NewTemplateBuilder()
+	vector := d.newDisk(disk)
+	if d.DiskFormat != "default" {
+		vector.AddValue("FORMAT", d.DiskFormat)
+	}
+	vector.AddValue("TYPE", "fs")
+	if d.DiskFS != "" {
+		vector.AddValue("FS", d.DiskFS)
+	}
+	vector.AddValue("SIZE", size)
+	vector.AddValue("DEV_PREFIX", d.devPrefix())
+
+	return d.attachDisk(disk)
+}
+
+// AttachImageDisk hot-attaches the image, given by name or ID, and returns
+// its DISK_ID
+func (d *Driver) AttachImageDisk(image string) (int, error) {
+	image_id, err := imageIdFromNameOrId(image)
+	if err != nil {
+		return 0, err
+	}
+
+	disk := goca.NewTemplateBuilder()
+	vector := d.newDisk(disk)
+	vector.AddValue("IMAGE_ID", image_id)
+	vector.AddValue("DEV_PREFIX", d.devPrefix())
+
+	return d.attachDisk(disk)
+}
+
+// DetachDisk hot-detaches a disk of the machine
+func (d *Driver) DetachDisk(diskId int) error {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return err
+	}
+
+	if err = vm.Info(); err != nil {
+		return err
+	}
+
+	_, lcm_state, err := vmStateString(vm)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Detaching disk %d from %s...", diskId, d.MachineName)
+	if _, err = goca.Client().Call("one.vm.detach", vm.Id, diskId); err != nil {
+		return err
+	}
+
+	return d.waitForLCMState(vm, lcm_state)
+}
+
+// Migrate moves the running machine to the host given by name or ID. Live
+// migrations keep the machine running, the others save and restore it
+func (d *Driver) Migrate(host string, live bool) error {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return err
+	}
+
+	host_id, err := hostIdFromNameOrId(host)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Migrating %s to host %s...", d.MachineName, host)
+	// Capacity and cluster are enforced, the system datastore is kept
+	if _, err = goca.Client().Call("one.vm.migrate", vm.Id, host_id, live, true, -1); err != nil {
+		return err
+	}
+
+	return d.waitForLCMState(vm, "RUNNING")
+}
+
+// Reschedule flags the machine for the scheduler to migrate it to another
+// host matching its requirements, e.g. to drain the current one
+func (d *Driver) Reschedule() error {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Rescheduling %s...", d.MachineName)
+	return vm.Action("resched")
+}
+
+func (d *Driver) attachDisk(disk *goca.TemplateBuilder) (int, error) {
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return 0, err
+	}
+
+	if err = vm.Info(); err != nil {
+		return 0, err
+	}
+
+	_, lcm_state, err := vmStateString(vm)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Infof("Attaching disk to %s...", d.MachineName)
+	if _, err = goca.Client().Call("one.vm.attach", vm.Id, disk.String()); err != nil {
+		return 0, err
+	}
+
+	if err = d.waitForLCMState(vm, lcm_state); err != nil {
+		return 0, err
+	}
+
+	// The attached disk gets the highest DISK_ID
+	vm_xml, err := callXML("one.vm.info", vm.Id)
+	if err != nil {
+		return 0, err
+	}
+
+	disk_id := -1
+	iter := xmlpath.MustCompile("/VM/TEMPLATE/DISK/DISK_ID").Iter(vm_xml)
+	for iter.Next() {
+		if id, err := strconv.Atoi(iter.Node().String()); err == nil && id > disk_id {
+			disk_id = id
+		}
+	}
+
+	if disk_id < 0 {
+		return 0, errors.New("Unable to find the attached disk of the VM")
+	}
+
+	return disk_id, nil
+}
+
+// RotateSSHKey replaces the machine key with a new one, in the
+// authorized_keys of the running machine and in the SSH_PUBLIC_KEY of the VM
+// context. The other authorized keys are kept. The old key is only dropped
+// once the machine accepts the new one
+func (d *Driver) RotateSSHKey() (err error) {
+	if d.NoContext {
+		return errors.New("The machine has no context to rotate its SSH key in")
+	}
+
+	vm, err := goca.NewVMFromName(d.vmName())
+	if err != nil {
+		return err
+	}
+
+	if err = vm.Info(); err != nil {
+		return err
+	}
+
+	oldKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return err
+	}
+	oldKey = bytes.TrimSpace(oldKey)
+
+	if keys, _ := vm.XPath("/VM/TEMPLATE/CONTEXT/SSH_PUBLIC_KEY"); !strings.Contains(keys, string(oldKey)) {
+		return errors.New("The machine key is not in the SSH_PUBLIC_KEY of the VM context")
+	}
+
+	oldConfig, err := sshClientConfig(d.SSHUser, d.GetSSHKeyPath())
+	if err != nil {
+		return err
+	}
+
+	newKeyPath := d.GetSSHKeyPath() + ".new"
+	if err = ssh.GenerateSSHKey(newKeyPath); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(newKeyPath)
+			os.Remove(newKeyPath + ".pub")
+		}
+	}()
+
+	newKey, err := ioutil.ReadFile(newKeyPath + ".pub")
+	if err != nil {
+		return err
+	}
+	newKey = bytes.TrimSpace(newKey)
+
+	newConfig, err := sshClientConfig(d.SSHUser, newKeyPath)
+	if err != nil {
+		return err
+	}
+
+	// The guest only reads the context on boot, the new key is authorized
+	// right away with the old one
+	log.Infof("Authorizing the new SSH key on %s...", d.MachineName)
+	command := fmt.Sprintf("touch ~/.ssh/authorized_keys && key=$(echo %s | base64 -d) && "+
+		"{ grep -qxF \"$key\" ~/.ssh/authorized_keys || echo \"$key\" >> ~/.ssh/authorized_keys; }",
+		base64.StdEncoding.EncodeToString(newKey))
+	if err = d.sshRun(oldConfig, command); err != nil {
+		return fmt.Errorf("Error authorizing the new SSH key, the machine has to be running: %s", err)
+	}
+
+	if err = d.sshRun(newConfig, "exit 0"); err != nil {
+		return fmt.Errorf("The machine does not accept the new SSH key: %s", err)
+	}
+
+	log.Infof("Updating the SSH key of %s...", d.MachineName)
+	err = updateContextKeys(vm, func(keys string) string {
+		return strings.Replace(keys, string(oldKey), string(newKey), 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(newKeyPath, d.GetSSHKeyPath()); err != nil {
+		return err
+	}
+
+	if err = os.Rename(newKeyPath+".pub", d.publicSSHKeyPath()); err != nil {
+		return err
+	}
+
+	command = fmt.Sprintf("key=$(echo %s | base64 -d) && "+
+		"{ grep -vxF \"$key\" ~/.ssh/authorized_keys > ~/.ssh/authorized_keys.new; mv ~/.ssh/authorized_keys.new ~/.ssh/authorized_keys; } && "+
+		"chmod 600 ~/.ssh/authorized_keys",
+		base64.StdEncoding.EncodeToString(oldKey))
+	if err := d.sshRun(newConfig, command); err != nil {
+		log.Warnf("The old SSH key could not be removed from the machine: %s", err)
+	}
+
+	return nil
+}
+
+// updateContextKeys rewrites the SSH_PUBLIC_KEY of the VM context with
+// update, keeping the other context attributes
+func updateContextKeys(vm *goca.VM, update func(string) string) error {
+	if err := vm.Info(); err != nil {
+		return err
+	}
+
+	var vm_template struct {
+		Context struct {
+			Attrs []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"TEMPLATE>CONTEXT"`
+	}
+	if err := xml.Unmarshal([]byte(vm.Body()), &vm_template); err != nil {
+		return err
+	}
+
+	// updateconf replaces the whole CONTEXT section
+	template := goca.NewTemplateBuilder()
+	vector := template.NewVector("CONTEXT")
+	found := false
+	for _, attr := range vm_template.Context.Attrs {
+		value := attr.Value
+		if attr.XMLName.Local == "SSH_PUBLIC_KEY" {
+			value = update(value)
+			found = true
+		}
+		vector.AddValue(attr.XMLName.Local, templateEscape(value))
+	}
+	if !found {
+		vector.AddValue("SSH_PUBLIC_KEY", templateEscape(update("")))
+	}
+
+	_, err := goca.Client().Call("one.vm.updateconf", vm.Id, template.String())
+	return err
+}
+
+// importImage registers a new image from the Boot2Docker URL (or the
+// Marketplace appliance) and waits for it to become READY. It tells whether
+// the image was allocated here or by a concurrent create
+func (d *Driver) importImage(name string) (uint, bool, error) {
+	app_template := ""
+	b2d_template := goca.NewTemplateBuilder()
+	b2d_template.AddValue("name", name)
+	if d.MarketplaceApp != "" {
+		var (
+			app_id string
+			err    error
+		)
+
+		app_id, app_template, err = marketplaceApp(d.MarketplaceApp)
+		if err != nil {
+			return 0, false, err
+		}
+
+		log.Infof("Exporting Marketplace appliance %s...", d.MarketplaceApp)
+		b2d_template.AddValue("from_app", app_id)
+		app_template += "\n"
+	} else {
+		b2d_template.AddValue("path", d.Boot2DockerURL)
+		if d.CDROM {
+			b2d_template.AddValue("type", "CDROM")
+		}
+	}
+	if d.Persistent {
+		b2d_template.AddValue("persistent", "YES")
+	}
+
+	ds_id, err := d.imageDatastoreId()
+	if err != nil {
+		return 0, false, err
+	}
+
+	b2d_id, err := goca.CreateImage(app_template+b2d_template.String(), ds_id)
+	if err != nil {
+		return d.concurrentImage(name, err)
+	}
+
+	if err = d.waitForImage(goca.NewImage(b2d_id)); err != nil {
+		return 0, false, err
+	}
+
+	return b2d_id, true, nil
+}
+
+// cloneImage copies the base image into the selected datastore under the
+// given name and waits for the copy to become READY
+func (d *Driver) cloneImage(name string) (uint, bool, error) {
+	base_id, err := imageIdFromNameOrId(d.BaseImage)
+	if err != nil {
+		return 0, false, err
+	}
+
+	ds_id, err := d.imageDatastoreId()
+	if err != nil {
+		return 0, false, err
+	}
+
+	log.Infof("Cloning base image %s...", d.BaseImage)
+	response, err := goca.Client().Call("one.image.clone", base_id, name, ds_id)
+	if err != nil {
+		return d.concurrentImage(name, err)
+	}
+
+	clone_id := uint(response.BodyInt())
+	if err = d.waitForImage(goca.NewImage(clone_id)); err != nil {
+		return 0, false, err
+	}
+
+	return clone_id, true, nil
+}
+
+// genericDataDisk tells whether the machine mounts a data disk of its own
+// on /var/lib/docker, which Boot2Docker does by itself
+func (d *Driver) genericDataDisk() bool {
+	return d.OSType == "generic" && (d.DataDisk || d.DataImageId != "" || d.DataImageName != "")
+}
+
+// dataDevPrefix is the DEV_PREFIX of the data disk: the one of the OS
+// disk, which generic images take from the image unless
+// --opennebula-dev-prefix is set, e.g. vd for most cloud images
+func (d *Driver) dataDevPrefix(image_id uint) (string, error) {
+	if !d.genericDataDisk() || d.DevPrefix != "" {
+		return d.devPrefix(), nil
+	}
+
+	image := goca.NewImage(image_id)
+	if err := image.Info(); err != nil {
+		return "", err
+	}
+
+	if prefix, ok := image.XPath("/IMAGE/TEMPLATE/DEV_PREFIX"); ok && prefix != "" {
+		return prefix, nil
+	}
+	return d.devPrefix(), nil
+}
+
+// dataDiskTarget is the device of the Docker data disk of generic images,
+// the one following the OS disk on its bus
+func dataDiskTarget(prefix string) string {
+	return prefix + "b"
+}
+
+// luksCommands returns the commands opening the LUKS device as name with
+// the LUKS_PASSPHRASE context attribute, encrypting it first when blank
+func luksCommands(device, name string) []string {
+	return []string{
+		fmt.Sprintf("cryptsetup isLuks /dev/%s || blkid /dev/%s || printf '%%s' \"$LUKS_PASSPHRASE\" | cryptsetup luksFormat -q /dev/%s -", device, device, device),
+		fmt.Sprintf("[ -e /dev/mapper/%s ] || printf '%%s' \"$LUKS_PASSPHRASE\" | cryptsetup open /dev/%s %s --key-file -", name, device, name),
+	}
+}
+
+// formatCommands returns the commands creating a filesystem on the device
+// unless it already has one
+func formatCommands(device string) []string {
+	return []string{
+		fmt.Sprintf("blkid /dev/%s || mkfs.ext4 -L docker-data /dev/%s", device, device),
+	}
+}
+
+// mountCommands returns the commands adding the device to fstab, so later
+// boots mount it before docker starts, and mounting it right away
+func mountCommands(device, path string) []string {
+	return []string{
+		fmt.Sprintf("mkdir -p %s", path),
+		fmt.Sprintf("grep -q ' %s ' /etc/fstab || echo '/dev/%s %s auto defaults,nofail 0 2' >> /etc/fstab", path, device, path),
+		fmt.Sprintf("mountpoint -q %s || mount %s", path, path),
+	}
+}
+
+// dataImageName is the name of the persistent data disk, kept across
+// machine removals so a machine with the same name finds its data again
+func (d *Driver) dataImageName() string {
+	return fmt.Sprintf("b2d-%s-data", d.MachineName)
+}
+
+// dataImage returns the persistent datablock holding the Docker data of the
+// machine, creating it on first use, and tells whether it was allocated here
+func (d *Driver) dataImage(name string) (uint, bool, error) {
+	if image, err := goca.NewImageFromName(name); err == nil {
+		return image.Id, false, d.waitForImage(image)
+	}
+
+	ds_id, err := d.imageDatastoreId()
+	if err != nil {
+		return 0, false, err
+	}
+
+	data_template := goca.NewTemplateBuilder()
+	data_template.AddValue("name", name)
+	data_template.AddValue("type", "DATABLOCK")
+	data_template.AddValue("size", d.DiskSize)
+	data_template.AddValue("fstype", "raw")
+	data_template.AddValue("persistent", "YES")
+	if d.LUKSSecret != "" {
+		data_template.AddValue("luks_secret", d.LUKSSecret)
+	}
+
+	log.Infof("Creating persistent data disk...")
+	data_id, err := goca.CreateImage(data_template.String(), ds_id)
+	if err != nil {
+		return d.concurrentImage(name, err)
+	}
+
+	if err = d.waitForImage(goca.NewImage(data_id)); err != nil {
+		return 0, false, err
+	}
+
+	return data_id, true, nil
+}
+
+// concurrentImage handles an image allocation that failed because a
+// concurrent create registered the same name first: that image is waited
+// for and used instead, and reported as not allocated by this process
+func (d *Driver) concurrentImage(name string, allocErr error) (uint, bool, error) {
+	image, err := goca.NewImageFromName(name)
+	if err != nil {
+		return 0, false, allocErr
+	}
+
+	log.Infof("Image %s is being registered by another process, waiting for it...", name)
+	if err = d.waitForImage(image); err != nil {
+		return 0, false, err
+	}
+
+	return image.Id, false, nil
+}
+
+// imageIdFromNameOrId resolves a numeric image ID or the name of an image
+// owned by the user
+func imageIdFromNameOrId(image string) (uint, error) {
+	if id, err := strconv.ParseUint(image, 10, 32); err == nil {
+		return uint(id), nil
+	}
+
+	i, err := goca.NewImageFromName(image)
+	if err != nil {
+		return 0, fmt.Errorf("Image %s: %s", image, err)
+	}
+
+	return i.Id, nil
+}
+
+// hostIdFromNameOrId resolves a numeric host ID or the name of a host
+func hostIdFromNameOrId(host string) (uint, error) {
+	if id, err := strconv.ParseUint(host, 10, 32); err == nil {
+		return uint(id), nil
+	}
+
+	pool, err := callXML("one.hostpool.info")
+	if err != nil {
+		return 0, err
+	}
+
+	iter := xmlpath.MustCompile("/HOST_POOL/HOST").Iter(pool)
+	for iter.Next() {
+		node := iter.Node()
+
+		if name, _ := xpathString(node, "NAME"); name != host {
+			continue
+		}
+
+		id, _ := xpathString(node, "ID")
+		host_id, err := strconv.ParseUint(id, 10, 32)
+		return uint(host_id), err
+	}
+
+	return 0, fmt.Errorf("Host %s not found", host)
+}
+
+// imageReadyTimeout is the --opennebula-image-ready-timeout of the machine,
+// the default for machines created before the option existed
+func (d *Driver) imageReadyTimeout() int {
+	if d.ImageReadyTimeout == 0 {
+		return defaultImageReadyTimeout
+	}
+	return d.ImageReadyTimeout
+}
+
+// waitForImage polls the image until it is READY, logging its size and the
+// time elapsed. Images that fail or time out are deleted so a retry can succeed
+func (d *Driver) waitForImage(image *goca.Image) error {
+	var (
+		err         error
+		image_state string
+		image_size  string
+	)
+
+	start := time.Now()
+	last := start
+	poll := d.newBackoff()
+	for image_state != "READY" && image_state != "USED" {
+		err = image.Info()
+		if err != nil {
+			return err
+		}
+
+		image_state, err = image.StateString()
+		if err != nil {
+			return err
+		}
+
+		switch image_state {
+		case "INIT", "LOCKED":
+			if time.Since(start) > time.Duration(d.imageReadyTimeout())*time.Second {
+				log.Errorf("Image %d not READY after %d seconds, removing it", image.Id, d.imageReadyTimeout())
+				image.Delete()
+				return errors.New("Timeout waiting for the image to become READY")
+			}
+
+			// SIZE is the size of the whole image, OpenNebula doesn't
+			// report how much of it is copied. Log it when it becomes
+			// known and every 10 seconds, so a stalled import shows
+			size, _ := image.XPath("/IMAGE/SIZE")
+			if size != image_size || time.Since(last) >= 10*time.Second {
+				image_size = size
+				last = time.Now()
+				log.Infof("Importing image of %s MB, %s elapsed...", size, time.Since(start)/time.Second*time.Second)
+			}
+			poll.Sleep()
+		case "READY", "USED":
+		case "ERROR":
+			msg, _ := image.XPath("/IMAGE/TEMPLATE/ERROR")
+			log.Errorf("Image %d in ERROR state: %s", image.Id, msg)
+			image.Delete()
+			return fmt.Errorf("Error registering the image: %s", msg)
+		default:
+			log.Errorf("Unexpected image state %s", image_state)
+			return errors.New("Unexpected image state")
+		}
+	}
+
+	return nil
+}
+
+// upgrade swaps the OS disk of a stopped Boot2Docker machine for a newly
+// imported image. "docker-machine upgrade" stops the machine, downloads the
+// latest ISO into the machine directory and starts it again, so an ISO newer
+// than the registered image is taken as an upgrade request
+func (d *Driver) upgrade(vm *goca.VM) error {
+	if d.OSType != "boot2docker" || d.MarketplaceApp != "" || d.BaseImage != "" {
+		return nil
+	}
+
+	iso, err := os.Stat(d.ResolveStorePath("boot2docker.iso"))
+	if err != nil {
+		return nil
+	}
+
+	b2d_name := fmt.Sprintf("b2d-%s", d.MachineName)
+	b2d_image, err := goca.NewImageFromName(b2d_name)
+	if err != nil {
+		return err
+	}
+
+	if err = b2d_image.Info(); err != nil {
+		return err
+	}
+
+	regtime, _ := b2d_image.XPath("/IMAGE/REGTIME")
+	if t, _ := strconv.ParseInt(regtime, 10, 64); iso.ModTime().Unix() <= t {
+		return nil
+	}
+
+	if err = vm.Info(); err != nil {
+		return err
+	}
+
+	// Machines stopped with --opennebula-stop-undeploys or
+	// --opennebula-stop-suspends can't have their disks swapped, they are
+	// brought back and powered off hard as the old OS is discarded anyway
+	switch vm_state, _, _ := vmStateString(vm); vm_state {
+	case "POWEROFF":
+	case "UNDEPLOYED", "SUSPENDED", "STOPPED":
+		log.Infof("Powering off the %s VM to upgrade Boot2Docker...", vm_state)
+		if err = vm.Resume(); err != nil {
+			return err
+		}
+
+		if err = d.waitForLCMState(vm, "RUNNING"); err != nil {
+			return err
+		}
+
+		if err = vm.Action("poweroff-hard"); err != nil {
+			return err
+		}
+
+		if err = d.waitForVMState(vm, "POWEROFF"); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	disk_id, ok := vm.XPath(fmt.Sprintf("/VM/TEMPLATE/DISK[IMAGE_ID='%d']/DISK_ID", b2d_image.Id))
+	if !ok {
+		return errors.New("Unable to find the Boot2Docker disk of the VM")
+	}
+
+	if err = d.snapshotDisks(vm, "upgrade"); err != nil {
+		return err
+	}
+
+	log.Infof("Upgrading Boot2Docker image...")
+	new_id, _, err := d.importImage(b2d_name + "-upgrade")
+	if err != nil {
+		return err
+	}
+
+	id, _ := strconv.Atoi(disk_id)
+	if _, err = goca.Client().Call("one.vm.detach", vm.Id, id); err != nil {
+		return err
+	}
+
+	if err = d.waitForVMState(vm, "POWEROFF"); err != nil {
+		return err
+	}
+
+	disk := goca.NewTemplateBuilder()
+	vector := d.newDisk(disk)
+	vector.AddValue("IMAGE_ID", new_id)
+	if d.CDROM {
+		vector.AddValue("DEV_PREFIX", "hd")
+	} else {
+		vector.AddValue("DEV_PREFIX", d.devPrefix())
+	}
+
+	if _, err = goca.Client().Call("one.vm.attach", vm.Id, disk.String()); err != nil {
+		return err
+	}
+
+	if err = d.waitForVMState(vm, "POWEROFF"); err != nil {
+		return err
+	}
+
+	if err = b2d_image.Delete(); err != nil {
+		return err
+	}
+
+	_, err = goca.Client().Call("one.image.rename", new_id, b2d_name)
+	return err
+}
+
+// snapshotDisks snapshots the image disks of the VM before a destructive
+// operation, so the machine can be rolled back with one.vm.disksnapshotrevert
+func (d *Driver) snapshotDisks(vm *goca.VM, operation string) error {
+	if !d.SnapshotDisks {
+		return nil
+	}
+
+	if err := vm.Info(); err != nil {
+		return err
+	}
+
+	_, lcm_state, err := vmStateString(vm)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s", operation, time.Now().Format("20060102-150405"))
+
+	vm_xml, err := callXML("one.vm.info", vm.Id)
+	if err != nil {
+		return err
+	}
+
+	// CDROMs are read only and volatile disks have no image to snapshot
+	iter := xmlpath.MustCompile("/VM/TEMPLATE/DISK[IMAGE_ID]").Iter(vm_xml)
+	var disks []string
+	for iter.Next() {
+		disk := iter.Node()
+		if disk_type, _ := xpathString(disk, "TYPE"); disk_type == "CDROM" {
+			continue
+		}
+		disk_id, _ := xpathString(disk, "DISK_ID")
+		disks = append(disks, disk_id)
+	}
+
+	for _, disk_id := range disks {
+		log.Infof("Taking snapshot %s of disk %s...", name, disk_id)
+
+		id, _ := strconv.Atoi(disk_id)
+		if _, err := goca.Client().Call("one.vm.disksnapshotcreate", vm.Id, id, name); err != nil {
+			return err
+		}
+
+		if err := d.waitForLCMState(vm, lcm_state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Names of the VM and LCM states past the ones the vendored goca knows, which
+// indexes its name tables without checking
+var (
+	extraVMStates = []string{
+		"CLONING",
+		"CLONING_FAILURE",
+	}
+	extraLCMStates = []string{
+		"PROLOG_MIGRATE_UNKNOWN",
+		"PROLOG_MIGRATE_UNKNOWN_FAILURE",
+		"DISK_RESIZE",
+		"DISK_RESIZE_POWEROFF",
+		"DISK_RESIZE_UNDEPLOYED",
+		"HOTPLUG_NIC_POWEROFF",
+		"HOTPLUG_RESIZE",
+		"HOTPLUG_SAVEAS_UNDEPLOYED",
+		"HOTPLUG_SAVEAS_STOPPED",
+		"BACKUP",
+		"BACKUP_POWEROFF",
+	}
+)
+
+// vmStateString is goca's StateString for the states of newer OpenNebula
+// versions too. States no table knows are named after their number
+func vmStateString(vm *goca.VM) (string, string, error) {
+	vm_state, lcm_state, err := vm.State()
+	if err != nil {
+		return "", "", err
+	}
+
+	vm_name := fmt.Sprintf("VM_STATE_%d", vm_state)
+	if known := int(goca.VM_UNDEPLOYED) + 1; vm_state >= 0 && vm_state < known {
+		vm_name = goca.VM_STATE(vm_state).String()
+	} else if vm_state >= known && vm_state < known+len(extraVMStates) {
+		vm_name = extraVMStates[vm_state-known]
+	}
+
+	lcm_name := fmt.Sprintf("LCM_STATE_%d", lcm_state)
+	if known := int(goca.DISK_SNAPSHOT_DELETE) + 1; lcm_state >= 0 && lcm_state < known {
+		lcm_name = goca.LCM_STATE(lcm_state).String()
+	} else if lcm_state >= known && lcm_state < known+len(extraLCMStates) {
+		lcm_name = extraLCMStates[lcm_state-known]
+	}
+
+	return vm_name, lcm_name, nil
+}
+
+// isNotFound tells whether the error is the one goca returns when no resource
+// has the name looked up, or the one oned returns for a missing ID
+func isNotFound(err error) bool {
+	return err.Error() == "Resource not found." || strings.Contains(err.Error(), "Error getting")
+}
+
+// pollInterval is the first pause of the wait loops, doubled after every
+// poll up to --opennebula-poll-max-interval
+const pollInterval = 1 * time.Second
+
+// stateTimeout bounds the waits for disk operations and state changes
+// other than boot and power off
+const stateTimeout = 100 * time.Second
+
+// lockTimeout is the age after which a store lock is considered stale
+const lockTimeout = 5 * time.Minute
+
+// nameRetries is the number of names tried for resources whose name is
+// already taken
+const nameRetries = 10
+
+// backoff spaces out the polls of a wait loop exponentially, with some
+// jitter so machines created together don't poll the frontend in lockstep
+type backoff struct {
+	next time.Duration
+	max  time.Duration
+}
+
+func (d *Driver) newBackoff() *backoff {
+	max := time.Duration(d.pollMaxInterval()) * time.Second
+	if max < pollInterval {
+		max = pollInterval
+	}
+	return &backoff{next: pollInterval, max: max}
+}
+
+// Sleep pauses between 50% and 150% of the current interval, then doubles it
+func (b *backoff) Sleep() {
+	time.Sleep(b.next/2 + time.Duration(rand.Int63n(int64(b.next))))
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+}
+
+// waitForLCMState waits for the VM to get back to the LCM state, e.g.
+// RUNNING after a disk operation on an active VM
+func (d *Driver) waitForLCMState(vm *goca.VM, target string) error {
+	deadline := time.Now().Add(stateTimeout)
+	poll := d.newBackoff()
+	for time.Now().Before(deadline) {
+		if err := vm.Info(); err != nil {
+			return err
+		}
+
+		_, lcm_state, err := vmStateString(vm)
+		if err != nil {
+			return err
+		}
+
+		if lcm_state == target {
+			return nil
+		}
+
+		poll.Sleep()
+	}
+
+	return fmt.Errorf("Timeout waiting for the VM to reach %s state", target)
+}
+
+// waitForLCMChange waits for the VM to leave the LCM state, e.g. a
+// *_FAILURE state once it is recovered
+func (d *Driver) waitForLCMChange(vm *goca.VM, from string) error {
+	deadline := time.Now().Add(stateTimeout)
+	poll := d.newBackoff()
+	for time.Now().Before(deadline) {
+		if err := vm.Info(); err != nil {
+			return err
+		}
+
+		_, lcm_state, err := vmStateString(vm)
+		if err != nil {
+			return err
+		}
+
+		if lcm_state != from {
+			return nil
+		}
+
+		poll.Sleep()
+	}
+
+	return fmt.Errorf("Timeout waiting for the VM to leave %s state", from)
+}
+
+// waitForVMState polls the VM until it reaches the given OpenNebula state
+func (d *Driver) waitForVMState(vm *goca.VM, target string) error {
+	deadline := time.Now().Add(stateTimeout)
+	poll := d.newBackoff()
+	for time.Now().Before(deadline) {
+		if err := vm.Info(); err != nil {
+			return err
+		}
+
+		vm_state, _, err := vmStateString(vm)
+		if err != nil {
+			return err
+		}
+
+		if vm_state == target {
+			return nil
+		}
+
+		poll.Sleep()
+	}
+
+	return fmt.Errorf("Timeout waiting for the VM to reach %s state", target)
+}
+
+// sshAvailable checks that the machine accepts SSH connections, dialing it
+// from the jump host if one is set and verifying its host key if requested
+func (d *Driver) sshAvailable() bool {
+	machine_config, err := sshClientConfig(d.SSHUser, d.GetSSHKeyPath())
+	if err != nil {
+		log.Debugf("Error reading the machine key: %s", err)
+		return false
+	}
+
+	if err := d.sshRun(machine_config, "exit 0"); err != nil {
+		log.Debugf("%s", err)
+		return false
+	}
+
+	return true
+}
+
+// bootedSince tells whether the machine is reachable over SSH and booted
+// after t, i.e. its uptime is shorter than the time elapsed since t
+func (d *Driver) bootedSince(t time.Time) bool {
+	machine_config, err := sshClientConfig(d.SSHUser, d.GetSSHKeyPath())
+	if err != nil {
+		log.Debugf("Error reading the machine key: %s", err)
+		return false
+	}
+
+	command := fmt.Sprintf("[ $(cut -d. -f1 /proc/uptime) -le %d ]", int(time.Since(t).Seconds())+1)
+	if err := d.sshRun(machine_config, command); err != nil {
+		log.Debugf("%s", err)
+		return false
+	}
+
+	return true
+}
+
+// provisionSSHKey logs in with the password of the machine and authorizes
+// the machine key, for images that ignore SSH_PUBLIC_KEY
+func (d *Driver) provisionSSHKey() bool {
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		log.Debugf("Error reading the machine key: %s", err)
+		return false
+	}
+
+	password_config := &cryptossh.ClientConfig{
+		User: d.SSHUser,
+		Auth: []cryptossh.AuthMethod{
+			cryptossh.Password(d.Password),
+			cryptossh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = d.Password
+				}
+				return answers, nil
+			}),
+		},
+	}
+
+	// Start authorizes the key on every run, it is only added once
+	command := fmt.Sprintf("mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && key=$(echo %s | base64 -d) && "+
+		"{ grep -qxF \"$key\" ~/.ssh/authorized_keys || echo \"$key\" >> ~/.ssh/authorized_keys; } && chmod 600 ~/.ssh/authorized_keys",
+		base64.StdEncoding.EncodeToString(bytes.TrimSpace(pubKey)))
+	if err := d.sshRun(password_config, command); err != nil {
+		log.Debugf("%s", err)
+		return false
+	}
+
+	return true
+}
+
+// sshRun runs the command on the machine, through the jump host if one is
+// set and checking the host key when asked to
+func (d *Driver) sshRun(machine_config *cryptossh.ClientConfig, command string) error {
+	if d.SSHHostKeyCheck {
+		expected, err := d.expectedHostKey()
+		if err != nil {
+			return fmt.Errorf("Error reading the recorded host key: %s", err)
+		}
+
+		if expected != nil {
+			machine_config.HostKeyAlgorithms = []string{expected.Type()}
+		}
+
+		// Without a published or recorded key the first one offered
+		// is trusted and recorded for the next connections
+		machine_config.HostKeyCallback = func(hostname string, remote net.Addr, key cryptossh.PublicKey) error {
+			if expected == nil {
+				d.SSHHostKey = strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(key)))
+				return nil
+			}
+
+			if !bytes.Equal(key.Marshal(), expected.Marshal()) {
+				d.hostKeyErr = fmt.Errorf("The SSH host key of %s does not match the one recorded for the machine", hostname)
+				return d.hostKeyErr
+			}
+			return nil
+		}
+	}
+
+	host, err := d.GetSSHHostname()
+	if err != nil {
+		return fmt.Errorf("Error getting the machine address: %s", err)
+	}
+
+	port, _ := d.GetSSHPort()
+	machine_addr := net.JoinHostPort(host, strconv.Itoa(port))
 
-		b2d_state := ""
-		for b2d_state != "READY" {
-			err = b2d_image.Info()
-			if err != nil {
-				return err
-			}
+	var conn net.Conn
+	if d.SSHBastionHost != "" {
+		bastion_config, err := sshClientConfig(d.SSHBastionUser, d.SSHBastionKey)
+		if err != nil {
+			return fmt.Errorf("Error reading the jump host key: %s", err)
+		}
 
-			b2d_state, err = b2d_image.StateString()
-			if err != nil {
-				return err
-			}
+		bastion_addr := d.SSHBastionHost
+		if _, _, err := net.SplitHostPort(bastion_addr); err != nil {
+			bastion_addr = net.JoinHostPort(bastion_addr, "22")
+		}
 
-			switch b2d_state {
-			case "INIT", "LOCKED":
-				time.Sleep(1 * time.Second)
-			case "READY":
-			default:
-				log.Errorf("Unexpected image state %s", b2d_state)
-				return errors.New("Unexpected image state")
-			}
+		bastion, err := cryptossh.Dial("tcp", bastion_addr, bastion_config)
+		if err != nil {
+			return fmt.Errorf("Error connecting to the jump host: %s", err)
 		}
+		defer bastion.Close()
 
-		log.Infof("Boot2Docker image registered...")
+		conn, err = bastion.Dial("tcp", machine_addr)
 	} else {
-		b2d_id = b2d_image.Id
+		conn, err = net.DialTimeout("tcp", machine_addr, 10*time.Second)
 	}
-
-	log.Infof("Creating SSH key...")
-	if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
-		return err
+	if err != nil {
+		return fmt.Errorf("Error connecting to %s: %s", machine_addr, err)
 	}
 
-	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	c, chans, reqs, err := cryptossh.NewClientConn(conn, machine_addr, machine_config)
 	if err != nil {
-		return err
+		conn.Close()
+		return fmt.Errorf("Error opening SSH connection: %s", err)
 	}
 
-	// Create template
-	template := goca.NewTemplateBuilder()
-	template.AddValue("NAME", d.MachineName)
-	template.AddValue("CPU", d.CPU)
-	template.AddValue("MEMORY", d.Memory)
+	client := cryptossh.NewClient(c, chans, reqs)
+	defer client.Close()
 
-	if d.VCPU != "" {
-		template.AddValue("VCPU", d.VCPU)
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("Error opening SSH session: %s", err)
 	}
+	defer session.Close()
 
-	vector := template.NewVector("NIC")
-	if d.NetworkName != "" {
-		vector.AddValue("NETWORK", d.NetworkName)
-  	 	if d.NetworkOwner != "" {
-			vector.AddValue("NETWORK_UNAME", d.NetworkOwner)
+	return session.Run(command)
+}
+
+// expectedHostKey returns the host key recorded for the machine, or the one
+// the guest published in the VM user template through OneGate
+func (d *Driver) expectedHostKey() (cryptossh.PublicKey, error) {
+	if d.SSHHostKey == "" {
+		vm, err := goca.NewVMFromName(d.vmName())
+		if err != nil {
+			return nil, err
 		}
-	}
-        if d.NetworkId != "" {
-		vector.AddValue("NETWORK_ID", d.NetworkId)
-	}
-	vector = template.NewVector("DISK")
-	vector.AddValue("IMAGE_ID", b2d_id)
-	vector.AddValue("DEV_PREFIX", "sd")
 
-	vector = template.NewVector("DISK")
-	vector.AddValue("FORMAT", "raw")
-	vector.AddValue("TYPE", "fs")
-	vector.AddValue("SIZE", string(d.DiskSize))
-	vector.AddValue("DEV_PREFIX", "sd")
+		if err = vm.Info(); err != nil {
+			return nil, err
+		}
+
+		if key, ok := vm.XPath("/VM/USER_TEMPLATE/SSH_HOST_KEY"); ok && key != "" {
+			d.SSHHostKey = key
+		}
+	}
 
-	vector = template.NewVector("CONTEXT")
-	vector.AddValue("NETWORK", "YES")
-	vector.AddValue("SSH_PUBLIC_KEY", string(pubKey))
+	if d.SSHHostKey == "" {
+		return nil, nil
+	}
 
-	vector = template.NewVector("GRAPHICS")
-	vector.AddValue("LISTEN", "0.0.0.0")
-	vector.AddValue("TYPE", "vnc")
+	key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(d.SSHHostKey))
+	return key, err
+}
 
-	// Instantiate
-	log.Infof("Starting  VM...")
-	_, err = goca.CreateVM(template.String(), false)
+func sshClientConfig(user, keyPath string) (*cryptossh.ClientConfig, error) {
+	key, err := ioutil.ReadFile(keyPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if d.IPAddress, err = d.GetIP(); err != nil {
-		return err
+	signer, err := cryptossh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := d.Start(); err != nil {
-		return err
-	}
+	return &cryptossh.ClientConfig{
+		User: user,
+		Auth: []cryptossh.AuthMethod{cryptossh.PublicKeys(signer)},
+	}, nil
+}
 
-	return nil
+func (d *Driver) publicSSHKeyPath() string {
+	return d.GetSSHKeyPath() + ".pub"
 }
 
-func (d *Driver) GetURL() (string, error) {
-	ip, err := d.GetIP()
+// networkId resolves the network given by name, and optionally owner name or
+// ID, or by ID
+func (d *Driver) networkId() (uint, error) {
+	if d.NetworkId != "" {
+		id, err := strconv.ParseUint(d.NetworkId, 10, 32)
+		return uint(id), err
+	}
+
+	// Like the NETWORK of a NIC, a name without an owner is one of the
+	// networks of the user
+	filter := goca.PoolWhoMine
+	if d.NetworkOwner != "" || d.NetworkOwnerId != "" {
+		filter = goca.PoolWhoAll
+	}
+
+	pool, err := callXML("one.vnpool.info", filter, -1, -1)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-	return fmt.Sprintf("tcp://%s:2376", ip), nil
+
+	iter := xmlpath.MustCompile("/VNET_POOL/VNET").Iter(pool)
+	for iter.Next() {
+		node := iter.Node()
+
+		name, _ := xpathString(node, "NAME")
+		uname, _ := xpathString(node, "UNAME")
+		uid, _ := xpathString(node, "UID")
+		if name != d.NetworkName ||
+			(d.NetworkOwner != "" && uname != d.NetworkOwner) ||
+			(d.NetworkOwnerId != "" && uid != d.NetworkOwnerId) {
+			continue
+		}
+
+		id, _ := xpathString(node, "ID")
+		vnet_id, err := strconv.ParseUint(id, 10, 32)
+		return uint(vnet_id), err
+	}
+
+	return 0, fmt.Errorf("Network %s not found", d.NetworkName)
 }
 
-func (d *Driver) GetIP() (string, error) {
-	vm, err := goca.NewVMFromName(d.MachineName)
+// reserveNetwork carves a reservation for the machine out of its network and
+// returns the ID of the reserved network
+func (d *Driver) reserveNetwork() (string, error) {
+	parent_id, err := d.networkId()
 	if err != nil {
 		return "", err
 	}
 
-	err = vm.Info()
+	// Concurrent reservations from the same network may pick the same
+	// free range, so the machines of a store reserve one at a time
+	unlock, err := d.storeLock()
 	if err != nil {
 		return "", err
 	}
+	defer unlock()
 
-	if ip, ok := vm.XPath("/VM/TEMPLATE/NIC/IP"); ok {
-		d.IPAddress = ip
+	// The name stays taken by a reservation left by a failed create, or
+	// by a machine with the same name in another store
+	name := fmt.Sprintf("%s-reservation", d.MachineName)
+	for attempt := 1; ; attempt++ {
+		reservation := goca.NewTemplateBuilder()
+		reservation.AddValue("NAME", name)
+		reservation.AddValue("SIZE", d.ReserveSize)
+
+		log.Infof("Reserving %d addresses...", d.ReserveSize)
+		response, err := goca.Client().Call("one.vn.reserve", parent_id, reservation.String())
+		if err == nil {
+			return strconv.Itoa(response.BodyInt()), nil
+		}
+
+		if attempt == nameRetries || !isNameTaken(err) {
+			return "", err
+		}
+
+		log.Infof("Name %s is already taken, retrying...", name)
+		name = fmt.Sprintf("%s-reservation-%d", d.MachineName, attempt)
 	}
+}
 
-	if d.IPAddress == "" {
-		return "", fmt.Errorf("IP address is not set")
+// storeLock serializes the operations concurrent creates from the same store
+// would race on. The lock is a file created exclusively, files older than
+// lockTimeout were left by a killed process and are taken over
+func (d *Driver) storeLock() (func(), error) {
+	path := filepath.Join(d.StorePath, "opennebula.lock")
+	poll := d.newBackoff()
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > lockTimeout {
+			log.Debugf("Taking over the stale lock %s", path)
+			os.Remove(path)
+			continue
+		}
+
+		log.Debugf("Waiting for the lock %s...", path)
+		poll.Sleep()
 	}
+}
 
-	return d.IPAddress, nil
+// isNameTaken tells whether oned refused an allocation because another
+// resource already has the name
+func isNameTaken(err error) bool {
+	return strings.Contains(err.Error(), "already taken")
 }
 
-func (d *Driver) GetState() (state.State, error) {
-	vm, err := goca.NewVMFromName(d.MachineName)
+// imageDatastoreId looks up the datastore selected by name or ID and checks
+// that it is an IMAGE datastore
+func (d *Driver) imageDatastoreId() (uint, error) {
+	pool, err := callXML("one.datastorepool.info")
 	if err != nil {
-		return state.None, err
+		return 0, err
 	}
 
-	err = vm.Info()
-	if err != nil {
-		return state.None, err
-	}
+	iter := xmlpath.MustCompile("/DATASTORE_POOL/DATASTORE").Iter(pool)
+	for iter.Next() {
+		node := iter.Node()
 
-	vm_state, lcm_state, err := vm.StateString()
-	if err != nil {
-		return state.None, err
-	}
+		name, _ := xpathString(node, "NAME")
+		id, _ := xpathString(node, "ID")
+		if d.DatastoreName != "" && name != d.DatastoreName {
+			continue
+		}
+		if d.DatastoreName == "" && id != d.DatastoreId {
+			continue
+		}
 
-	switch vm_state {
-	case "INIT", "PENDING", "HOLD":
-		return state.Starting, nil
-	case "ACTIVE":
-		switch lcm_state {
-		case "RUNNING",
-			"DISK_SNAPSHOT",
-			"DISK_SNAPSHOT_REVERT",
-			"DISK_SNAPSHOT_DELETE",
-			"HOTPLUG",
-			"HOTPLUG_SNAPSHOT",
-			"HOTPLUG_NIC",
-			"HOTPLUG_SAVEAS":
-			return state.Running, nil
-		case "PROLOG",
-			"BOOT",
-			"MIGRATE",
-			"PROLOG_MIGRATE",
-			"PROLOG_RESUME",
-			"CLEANUP_RESUBMIT",
-			"BOOT_UNKNOWN",
-			"BOOT_POWEROFF",
-			"BOOT_SUSPENDED",
-			"BOOT_STOPPED",
-			"PROLOG_UNDEPLOY",
-			"BOOT_UNDEPLOY",
-			"BOOT_MIGRATE",
-			"PROLOG_MIGRATE_SUSPEND",
-			"SAVE_MIGRATE":
-			return state.Starting, nil
-		case "HOTPLUG_SAVEAS_POWEROFF",
-			"DISK_SNAPSHOT_POWEROFF",
-			"DISK_SNAPSHOT_REVERT_POWEROFF",
-			"DISK_SNAPSHOT_DELETE_POWEROFF",
-			"HOTPLUG_PROLOG_POWEROFF",
-			"HOTPLUG_EPILOG_POWEROFF",
-			"PROLOG_MIGRATE_POWEROFF",
-			"SAVE_STOP":
-			return state.Stopped, nil
-		case "HOTPLUG_SAVEAS_SUSPENDED",
-			"DISK_SNAPSHOT_SUSPENDED",
-			"DISK_SNAPSHOT_REVERT_SUSPENDED",
-			"DISK_SNAPSHOT_DELETE_SUSPENDED":
-			return state.Saved, nil
-		case "EPILOG_STOP",
-			"EPILOG",
-			"SHUTDOWN_UNDEPLOY",
-			"EPILOG_UNDEPLOY",
-			"SAVE_SUSPEND",
-			"SHUTDOWN",
-			"SHUTDOWN_POWEROFF",
-			"CANCEL",
-			"CLEANUP_DELETE":
-			return state.Stopping, nil
-		case "UNKNOWN",
-			"FAILURE",
-			"BOOT_FAILURE",
-			"BOOT_MIGRATE_FAILURE",
-			"PROLOG_MIGRATE_FAILURE",
-			"PROLOG_FAILURE",
-			"EPILOG_FAILURE",
-			"EPILOG_STOP_FAILURE",
-			"EPILOG_UNDEPLOY_FAILURE",
-			"PROLOG_MIGRATE_POWEROFF_FAILURE",
-			"PROLOG_MIGRATE_SUSPEND_FAILURE",
-			"BOOT_UNDEPLOY_FAILURE",
-			"BOOT_STOPPED_FAILURE",
-			"PROLOG_RESUME_FAILURE",
-			"PROLOG_UNDEPLOY_FAILURE":
-			return state.Error, nil
+		// TYPE 0 is IMAGE_DS, 1 is SYSTEM_DS and 2 is FILE_DS
+		if ds_type, _ := xpathString(node, "TYPE"); ds_type != "0" {
+			return 0, fmt.Errorf("Datastore %s (%s) is not an IMAGE datastore", name, id)
 		}
-	case "POWEROFF", "UNDEPLOYED":
-		return state.Stopped, nil
-	case "STOPPED", "SUSPENDED":
-		return state.Saved, nil
-	case "DONE", "FAILED":
-		return state.Error, nil
+
+		ds_id, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		return uint(ds_id), nil
 	}
 
-	return state.Error, nil
+	if d.DatastoreName != "" {
+		return 0, fmt.Errorf("Datastore %s not found", d.DatastoreName)
+	}
+	return 0, fmt.Errorf("Datastore %s not found", d.DatastoreId)
 }
 
-func (d *Driver) Start() error {
-	vm, err := goca.NewVMFromName(d.MachineName)
+// marketplaceApp looks up a READY image appliance by name or ID and returns
+// its ID together with the image template used to export it
+func marketplaceApp(app string) (string, string, error) {
+	pool, err := callXML("one.marketapppool.info", goca.PoolWhoAll, -1, -1)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	vm.Resume()
+	iter := xmlpath.MustCompile("/MARKETPLACEAPP_POOL/MARKETPLACEAPP").Iter(pool)
+	for iter.Next() {
+		node := iter.Node()
 
-	s := state.None
-	for retry := 0; retry < 50 && s != state.Running; retry++ {
-		s, err = d.GetState()
+		name, _ := xpathString(node, "NAME")
+		id, _ := xpathString(node, "ID")
+		if app != name && app != id {
+			continue
+		}
+
+		// TYPE 1 is IMAGE, STATE 1 is READY
+		if app_type, _ := xpathString(node, "TYPE"); app_type != "1" {
+			return "", "", fmt.Errorf("Marketplace appliance %s is not an image", app)
+		}
+		if app_state, _ := xpathString(node, "STATE"); app_state != "1" {
+			return "", "", fmt.Errorf("Marketplace appliance %s is not READY", app)
+		}
+
+		encoded, _ := xpathString(node, "TEMPLATE/APPTEMPLATE64")
+		template, err := base64.StdEncoding.DecodeString(encoded)
 		if err != nil {
-			return err
+			return "", "", err
 		}
 
-		switch s {
-		case state.Running:
-		case state.Error:
-			return errors.New("VM in error state")
+		return id, string(template), nil
+	}
+
+	return "", "", fmt.Errorf("Marketplace appliance %s not found", app)
+}
+
+// swarmMetadata returns the swarm settings of the machine published to the
+// guest, so nodes can join even if provisioning is interrupted
+func (d *Driver) swarmMetadata() [][2]string {
+	if d.SwarmDiscovery == "" {
+		return nil
+	}
+
+	master := "NO"
+	if d.SwarmMaster {
+		master = "YES"
+	}
+
+	return [][2]string{
+		{"SWARM_MASTER", master},
+		{"SWARM_HOST", d.SwarmHost},
+		{"SWARM_DISCOVERY", d.SwarmDiscovery},
+	}
+}
+
+// routes groups the static routes by interface, returning the interfaces in
+// the order they were first used
+func (d *Driver) routes() ([]string, map[string][]string, error) {
+	var devs []string
+	routes := map[string][]string{}
+
+	for _, route := range d.Routes {
+		fields := strings.Fields(route)
+
+		dev := "eth0"
+		switch {
+		case len(fields) == 3 && fields[1] == "via":
+		case len(fields) == 5 && fields[1] == "via" && fields[3] == "dev":
+			dev = fields[4]
 		default:
-			time.Sleep(2 * time.Second)
+			return nil, nil, fmt.Errorf("Invalid route %q, please use DEST via GATEWAY [dev ethN].", route)
+		}
+
+		dev = strings.ToUpper(dev)
+		if _, ok := routes[dev]; !ok {
+			devs = append(devs, dev)
 		}
+		routes[dev] = append(routes[dev], strings.Join(fields[:3], " "))
 	}
 
-	if d.IPAddress == "" {
-		if d.IPAddress, err = d.GetIP(); err != nil {
-			return err
+	return devs, routes, nil
+}
+
+// daemonJSON returns the daemon.json for the engine of the machine, or nil
+// when no daemon option is set
+func (d *Driver) daemonJSON() ([]byte, error) {
+	daemon := map[string]interface{}{}
+
+	if len(d.RegistryMirrors) > 0 {
+		daemon["registry-mirrors"] = d.RegistryMirrors
+	}
+	if len(d.InsecureRegistries) > 0 {
+		daemon["insecure-registries"] = d.InsecureRegistries
+	}
+	for _, opt := range d.DaemonOpts {
+		kv := strings.SplitN(opt, "=", 2)
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(kv[1]), &value); err != nil {
+			value = kv[1]
 		}
+		daemon[kv[0]] = value
 	}
 
-	log.Infof("Waiting for SSH...")
-	// Wait for SSH over NAT to be available before returning to user
-	if err := drivers.WaitForSSH(d); err != nil {
-		return err
+	if len(daemon) == 0 {
+		return nil, nil
 	}
 
-	return nil
+	return json.MarshalIndent(daemon, "", "  ")
 }
 
-func (d *Driver) Stop() error {
-	vm, err := goca.NewVMFromName(d.MachineName)
-	if err != nil {
-		return err
+// proxyCommands returns the commands setting the proxy environment of the
+// docker engine, in the boot2docker profile or in a systemd drop-in
+func (d *Driver) proxyCommands() []string {
+	var env [][2]string
+	for _, v := range [][2]string{
+		{"HTTP_PROXY", d.EngineHTTPProxy},
+		{"HTTPS_PROXY", d.EngineHTTPSProxy},
+		{"NO_PROXY", d.EngineNoProxy},
+	} {
+		if v[1] != "" {
+			env = append(env, v)
+		}
 	}
 
-	err = vm.PowerOff()
-	if err != nil {
-		return err
+	if len(env) == 0 {
+		return nil
 	}
 
-	return nil
+	var content bytes.Buffer
+	if d.OSType == "boot2docker" {
+		for _, v := range env {
+			fmt.Fprintf(&content, "export %s=%q\n", v[0], v[1])
+		}
+
+		// The provisioner rewrites the boot2docker profile and restarts
+		// docker, the exports go to a file of their own that the init
+		// script of the root filesystem, rebuilt on every boot, sources
+		return append(writeFileCommands(b2dProxyProfile, content.Bytes()),
+			fmt.Sprintf(`for f in /etc/init.d/docker /usr/local/etc/init.d/docker; do [ -f $f ] && { grep -qF %[1]s $f || sed -i "1a test -f %[1]s && . %[1]s" $f; }; done`,
+				b2dProxyProfile))
+	}
+
+	content.WriteString("[Service]\n")
+	for _, v := range env {
+		fmt.Fprintf(&content, "Environment=%q\n", v[0]+"="+v[1])
+	}
+	return append(writeFileCommands("/etc/systemd/system/docker.service.d/http-proxy.conf", content.Bytes()),
+		"systemctl daemon-reload")
 }
 
-func (d *Driver) Remove() error {
-	vm, err := goca.NewVMFromName(d.MachineName)
-	if err != nil {
-		return err
+// b2dProxyProfile holds the proxy exports of Boot2Docker machines, on the
+// persistent data disk next to the profile
+const b2dProxyProfile = "/var/lib/boot2docker/proxy"
+
+// writeFileCommands returns the commands writing the content to a file of
+// the guest
+func writeFileCommands(path string, content []byte) []string {
+	return []string{
+		fmt.Sprintf("mkdir -p %s", filepath.Dir(path)),
+		fmt.Sprintf("echo %s | base64 -d > %s", base64.StdEncoding.EncodeToString(content), path),
 	}
+}
 
-	err = vm.ShutdownHard()
-	if err != nil {
-		return err
+// bootScript prepends the commands to the user's start script. The user's
+// script is saved and run as is so its interpreter line keeps working
+func bootScript(commands []string, script string) string {
+	if len(commands) == 0 {
+		return script
 	}
 
-	return nil
+	s := "#!/bin/sh\n" + strings.Join(commands, "\n") + "\n"
+	if script != "" {
+		s += fmt.Sprintf("echo %s | base64 -d > /tmp/start-script\n", base64.StdEncoding.EncodeToString([]byte(script)))
+		s += "chmod +x /tmp/start-script\n"
+		s += "/tmp/start-script\n"
+	}
+
+	return s
 }
 
-func (d *Driver) Restart() error {
-	vm, err := goca.NewVMFromName(d.MachineName)
+// render executes the text as a Go template with the machine name, the
+// address and the SSH user known before the machine is created
+func (d *Driver) render(text string) (string, error) {
+	t, err := texttemplate.New("").Option("missingkey=error").Parse(text)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = vm.Reboot()
-	if err != nil {
-		return err
+	ip := d.IP
+	if d.StaticIP != "" {
+		ip = d.StaticIP
 	}
 
-	return nil
+	var b bytes.Buffer
+	err = t.Execute(&b, struct {
+		MachineName string
+		IPAddress   string
+		SSHUser     string
+	}{d.MachineName, ip, d.SSHUser})
+
+	return b.String(), err
 }
 
-func (d *Driver) Kill() error {
-	vm, err := goca.NewVMFromName(d.MachineName)
-	if err != nil {
-		return err
+// templateEscape escapes a value so it can be placed between the double
+// quotes of an OpenNebula template attribute
+func templateEscape(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	return strings.Replace(value, "\"", "\\\"", -1)
+}
+
+// attributeName tells whether the name is a valid template attribute name,
+// letters, digits and underscores not starting with a digit
+func attributeName(name string) bool {
+	for i, c := range name {
+		if !(c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
 	}
+	return name != ""
+}
 
-	err = vm.PowerOffHard()
+// callXML invokes an OpenNebula XML-RPC method that goca does not wrap and
+// parses the XML document it returns
+func callXML(method string, args ...interface{}) (*xmlpath.Node, error) {
+	response, err := goca.Client().Call(method, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return xmlpath.Parse(bytes.NewBufferString(response.Body()))
 }
 
-func (d *Driver) publicSSHKeyPath() string {
-	return d.GetSSHKeyPath() + ".pub"
+func xpathString(node *xmlpath.Node, path string) (string, bool) {
+	return xmlpath.MustCompile(path).String(node)
 }
@@ -1 +1,415 @@
 package opennebula
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/goca"
+)
+
+// testVM returns a VM whose XML is body, as served by a fake oned
+func testVM(t *testing.T, body string) *goca.VM {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(body))
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<?xml version="1.0"?><methodResponse><params><param><value><array><data>`+
+			`<value><boolean>1</boolean></value><value><string>%s</string></value><value><i4>0</i4></value>`+
+			`</data></array></value></param></params></methodResponse>`, escaped.String())
+	}))
+	defer server.Close()
+
+	os.Setenv("ONE_XMLRPC", server.URL)
+	defer os.Unsetenv("ONE_XMLRPC")
+	goca.SetClient("test")
+
+	vm := goca.NewVM(0)
+	if err := vm.Info(); err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		routes []string
+		devs   []string
+		byDev  map[string][]string
+		err    bool
+	}{
+		{nil, nil, map[string][]string{}, false},
+		{
+			[]string{"10.0.0.0/8 via 192.168.1.1"},
+			[]string{"ETH0"},
+			map[string][]string{"ETH0": {"10.0.0.0/8 via 192.168.1.1"}},
+			false,
+		},
+		{
+			[]string{"10.0.0.0/8 via 192.168.1.1 dev eth1", "172.16.0.0/12 via 192.168.2.1", "192.168.0.0/16 via 192.168.1.1 dev eth1"},
+			[]string{"ETH1", "ETH0"},
+			map[string][]string{
+				"ETH1": {"10.0.0.0/8 via 192.168.1.1", "192.168.0.0/16 via 192.168.1.1"},
+				"ETH0": {"172.16.0.0/12 via 192.168.2.1"},
+			},
+			false,
+		},
+		{[]string{"10.0.0.0/8 192.168.1.1"}, nil, nil, true},
+		{[]string{"10.0.0.0/8 via 192.168.1.1 eth1"}, nil, nil, true},
+	}
+
+	for _, test := range tests {
+		d := &Driver{Routes: test.routes}
+		devs, byDev, err := d.routes()
+		if (err != nil) != test.err {
+			t.Errorf("routes(%q): unexpected error %v", test.routes, err)
+			continue
+		}
+		if !reflect.DeepEqual(devs, test.devs) || !reflect.DeepEqual(byDev, test.byDev) {
+			t.Errorf("routes(%q) = %q, %q, want %q, %q", test.routes, devs, byDev, test.devs, test.byDev)
+		}
+	}
+}
+
+func TestDaemonJSON(t *testing.T) {
+	tests := []struct {
+		d    Driver
+		want string
+	}{
+		{Driver{}, ""},
+		{
+			Driver{
+				RegistryMirrors:    []string{"https://mirror.example.com"},
+				InsecureRegistries: []string{"registry.local:5000"},
+			},
+			"{\n  \"insecure-registries\": [\n    \"registry.local:5000\"\n  ],\n  \"registry-mirrors\": [\n    \"https://mirror.example.com\"\n  ]\n}",
+		},
+		{
+			Driver{DaemonOpts: []string{"max-concurrent-downloads=5", "log-driver=journald", "labels=[\"a=b\"]", "debug=true"}},
+			"{\n  \"debug\": true,\n  \"labels\": [\n    \"a=b\"\n  ],\n  \"log-driver\": \"journald\",\n  \"max-concurrent-downloads\": 5\n}",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := test.d.daemonJSON()
+		if err != nil {
+			t.Errorf("daemonJSON(): unexpected error %s", err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("daemonJSON() = %s, want %s", got, test.want)
+		}
+		if test.want == "" && got != nil {
+			t.Errorf("daemonJSON() = %q, want nil", got)
+		}
+	}
+}
+
+func TestWriteFileCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opennebula")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []string{
+		"",
+		"export HTTP_PROXY=\"http://proxy:3128\"\n",
+		"{\n  \"debug\": true\n}",
+		"'single' \"double\" $HOME `date` \\ \n\n",
+	}
+
+	for i, content := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("%d", i), "file")
+		// The start script runs on every boot, writing twice leaves the
+		// same content
+		for run := 0; run < 2; run++ {
+			script := strings.Join(writeFileCommands(path, []byte(content)), "\n")
+			if out, err := exec.Command("sh", "-c", script).CombinedOutput(); err != nil {
+				t.Fatalf("writeFileCommands(%q): %s: %s", content, err, out)
+			}
+		}
+
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("writeFileCommands(%q): %s", content, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("writeFileCommands(%q) wrote %q", content, got)
+		}
+	}
+}
+
+func TestProxyCommands(t *testing.T) {
+	tests := []struct {
+		d    Driver
+		want []string
+	}{
+		{Driver{OSType: "boot2docker"}, nil},
+		{
+			Driver{OSType: "generic", EngineHTTPProxy: "http://proxy:3128", EngineNoProxy: "localhost"},
+			[]string{
+				"mkdir -p /etc/systemd/system/docker.service.d",
+				"echo W1NlcnZpY2VdCkVudmlyb25tZW50PSJIVFRQX1BST1hZPWh0dHA6Ly9wcm94eTozMTI4IgpFbnZpcm9ubWVudD0iTk9fUFJPWFk9bG9jYWxob3N0Igo= | base64 -d > /etc/systemd/system/docker.service.d/http-proxy.conf",
+				"systemctl daemon-reload",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if got := test.d.proxyCommands(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("proxyCommands() = %q, want %q", got, test.want)
+		}
+	}
+
+	// The provisioner overwrites the boot2docker profile
+	d := Driver{OSType: "boot2docker", EngineHTTPSProxy: "http://proxy:3128"}
+	for _, command := range d.proxyCommands() {
+		if strings.Contains(command, "/var/lib/boot2docker/profile") {
+			t.Errorf("proxyCommands() writes the boot2docker profile: %s", command)
+		}
+	}
+}
+
+func TestBootScript(t *testing.T) {
+	tests := []struct {
+		commands []string
+		script   string
+		want     string
+	}{
+		{nil, "", ""},
+		{nil, "#!/bin/bash\necho hi\n", "#!/bin/bash\necho hi\n"},
+		{[]string{"mkdir -p /etc/docker", "hostname m"}, "", "#!/bin/sh\nmkdir -p /etc/docker\nhostname m\n"},
+		{
+			[]string{"hostname m"},
+			"#!/bin/bash\necho hi\n",
+			"#!/bin/sh\nhostname m\necho IyEvYmluL2Jhc2gKZWNobyBoaQo= | base64 -d > /tmp/start-script\nchmod +x /tmp/start-script\n/tmp/start-script\n",
+		},
+	}
+
+	for _, test := range tests {
+		if got := bootScript(test.commands, test.script); got != test.want {
+			t.Errorf("bootScript(%q, %q) = %q, want %q", test.commands, test.script, got, test.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		text     string
+		staticIP string
+		want     string
+		err      bool
+	}{
+		{"plain", "", "plain", false},
+		{"{{.MachineName}} {{.SSHUser}}", "", "m docker", false},
+		{"ip={{.IPAddress}}", "10.0.0.5", "ip=10.0.0.5", false},
+		{"{{.Unknown}}", "", "", true},
+		{"{{.MachineName", "", "", true},
+	}
+
+	for _, test := range tests {
+		d := NewDriver("m", "")
+		d.StaticIP = test.staticIP
+		got, err := d.render(test.text)
+		if (err != nil) != test.err {
+			t.Errorf("render(%q): unexpected error %v", test.text, err)
+			continue
+		}
+		if !test.err && got != test.want {
+			t.Errorf("render(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTemplateEscape(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{`from="10.0.0.0/8" ssh-ed25519 AAAA`, `from=\"10.0.0.0/8\" ssh-ed25519 AAAA`},
+		{`C:\path`, `C:\\path`},
+		{`\"`, `\\\"`},
+	}
+
+	for _, test := range tests {
+		if got := templateEscape(test.value); got != test.want {
+			t.Errorf("templateEscape(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestAttributeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"EXTERNAL_IP", true},
+		{"public_ip4", true},
+		{"_IP", true},
+		{"", false},
+		{"4IP", false},
+		{"IP']", false},
+		{"NIC/IP", false},
+		{"EXTERNAL-IP", false},
+	}
+
+	for _, test := range tests {
+		if got := attributeName(test.name); got != test.want {
+			t.Errorf("attributeName(%q) = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestVMStateString(t *testing.T) {
+	tests := []struct {
+		state string
+		lcm   string
+		vm    string
+		want  string
+	}{
+		{"3", "3", "ACTIVE", "RUNNING"},
+		{"8", "0", "POWEROFF", "LCM_INIT"},
+		{"3", "59", "ACTIVE", "DISK_SNAPSHOT_DELETE"},
+		{"3", "60", "ACTIVE", "PROLOG_MIGRATE_UNKNOWN"},
+		{"3", "62", "ACTIVE", "DISK_RESIZE"},
+		{"3", "70", "ACTIVE", "BACKUP_POWEROFF"},
+		{"3", "71", "ACTIVE", "LCM_STATE_71"},
+		{"10", "0", "CLONING", "LCM_INIT"},
+		{"11", "0", "CLONING_FAILURE", "LCM_INIT"},
+		{"12", "0", "VM_STATE_12", "LCM_INIT"},
+	}
+
+	for _, test := range tests {
+		vm := testVM(t, fmt.Sprintf("<VM><STATE>%s</STATE><LCM_STATE>%s</LCM_STATE></VM>", test.state, test.lcm))
+		vm_state, lcm_state, err := vmStateString(vm)
+		if err != nil {
+			t.Errorf("vmStateString(%s, %s): unexpected error %s", test.state, test.lcm, err)
+			continue
+		}
+		if vm_state != test.vm || lcm_state != test.want {
+			t.Errorf("vmStateString(%s, %s) = %s, %s, want %s, %s", test.state, test.lcm, vm_state, lcm_state, test.vm, test.want)
+		}
+	}
+
+	if _, _, err := vmStateString(testVM(t, "<VM></VM>")); err == nil {
+		t.Errorf("vmStateString() of a VM without state: expected an error")
+	}
+}
+
+func TestGuestIP(t *testing.T) {
+	tests := []struct {
+		monitoring  string
+		prefer_ipv6 bool
+		want        string
+	}{
+		{"", false, ""},
+		{"<GUEST_IP>10.0.0.9</GUEST_IP>", false, "10.0.0.9"},
+		{"<GUEST_IP_ADDRESSES>127.0.0.1,fe80::1,10.0.0.5,2001:db8::5</GUEST_IP_ADDRESSES>", false, "10.0.0.5"},
+		{"<GUEST_IP_ADDRESSES>127.0.0.1,fe80::1,10.0.0.5,2001:db8::5</GUEST_IP_ADDRESSES>", true, "2001:db8::5"},
+		{"<GUEST_IP_ADDRESSES>2001:db8::5, 10.0.0.5</GUEST_IP_ADDRESSES>", false, "10.0.0.5"},
+		{"<GUEST_IP_ADDRESSES>2001:db8::5</GUEST_IP_ADDRESSES>", false, "2001:db8::5"},
+		{"<GUEST_IP_ADDRESSES>::1,fe80::1</GUEST_IP_ADDRESSES><GUEST_IP>10.0.0.9</GUEST_IP>", false, "10.0.0.9"},
+	}
+
+	for _, test := range tests {
+		vm := testVM(t, "<VM><MONITORING>"+test.monitoring+"</MONITORING></VM>")
+		if got := guestIP(vm, test.prefer_ipv6); got != test.want {
+			t.Errorf("guestIP(%s, %t) = %q, want %q", test.monitoring, test.prefer_ipv6, got, test.want)
+		}
+	}
+}
+
+func TestVectorPath(t *testing.T) {
+	vm := testVM(t, "<VM><TEMPLATE>"+
+		"<NIC><NETWORK>public</NETWORK><NETWORK_ID>0</NETWORK_ID></NIC>"+
+		"<DISK><DISK_ID>0</DISK_ID></DISK>"+
+		"<NIC><NETWORK>o'brien</NETWORK><NETWORK_ID>7</NETWORK_ID></NIC>"+
+		"</TEMPLATE></VM>")
+
+	tests := []struct {
+		attr  string
+		value string
+		want  string
+		ok    bool
+	}{
+		{"NETWORK", "public", "/VM/TEMPLATE/NIC[1]", true},
+		{"NETWORK", "o'brien", "/VM/TEMPLATE/NIC[2]", true},
+		{"NETWORK_ID", "7", "/VM/TEMPLATE/NIC[2]", true},
+		{"NETWORK", "private", "", false},
+	}
+
+	for _, test := range tests {
+		got, ok := vectorPath(vm, "/VM/TEMPLATE/NIC", test.attr, test.value)
+		if got != test.want || ok != test.ok {
+			t.Errorf("vectorPath(%s, %q) = %q, %t, want %q, %t", test.attr, test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		pollMaxInterval int
+		want            time.Duration
+	}{
+		{0, defaultPollMaxInterval * time.Second},
+		{5, 5 * time.Second},
+		{-1, pollInterval},
+	}
+
+	for _, test := range tests {
+		d := &Driver{PollMaxInterval: test.pollMaxInterval}
+		b := d.newBackoff()
+		if b.next != pollInterval || b.max != test.want {
+			t.Errorf("newBackoff() with %d = %s, %s, want %s, %s", test.pollMaxInterval, b.next, b.max, pollInterval, test.want)
+		}
+	}
+
+	b := &backoff{next: time.Millisecond, max: 4 * time.Millisecond}
+	for _, want := range []time.Duration{2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond} {
+		b.Sleep()
+		if b.next != want {
+			t.Errorf("backoff.Sleep() next = %s, want %s", b.next, want)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	var d Driver
+	for _, test := range []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"ipTimeout", d.ipTimeout(), defaultIPTimeout},
+		{"bootTimeout", d.bootTimeout(), defaultBootTimeout},
+		{"pendingTimeout", d.pendingTimeout(), defaultPendingTimeout},
+		{"stopTimeout", d.stopTimeout(), defaultStopTimeout},
+		{"pollMaxInterval", d.pollMaxInterval(), defaultPollMaxInterval},
+		{"imageReadyTimeout", d.imageReadyTimeout(), defaultImageReadyTimeout},
+		{"stopGracePeriod", d.stopGracePeriod(), defaultStopGracePeriod},
+		{"readyWait", d.readyWait(), defaultReadyWait},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s() of a machine saved without it = %v, want %v", test.name, test.got, test.want)
+		}
+	}
+
+	d = Driver{BootTimeout: 30, StopGracePeriod: 5}
+	if d.bootTimeout() != 30 || d.stopGracePeriod() != 5 {
+		t.Errorf("bootTimeout(), stopGracePeriod() = %d, %d, want 30, 5", d.bootTimeout(), d.stopGracePeriod())
+	}
+}